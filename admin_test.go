@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+	"weisuo/serverhelper"
+)
+
+func TestAdmin(t *testing.T) {
+	tunnels := protocol.NewTunnels()
+
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.LogLevel = logger.LogLevelDebug
+		h.Tunnels = tunnels
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10086", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		err := http.ListenAndServe("127.0.0.1:10186", newAdminHandler("admin", tunnels, nil))
+		t.Log("listen failure 3", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10096")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				t.Log("accept failure", err)
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	request := func(method, path, key string, v interface{}) (int, error) {
+		req, err := http.NewRequest(method, "http://127.0.0.1:10186"+path, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && v != nil {
+			err = json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode, err
+	}
+
+	go func() {
+		status, err := request(http.MethodGet, "/tunnels", "wrong", nil)
+		if err != nil || status != http.StatusUnauthorized {
+			errCh <- fmt.Errorf("unauthorized request: %d %v", status, err)
+			return
+		}
+
+		dialer := protocol.DefaultDialer()
+		dialer.LogLevel = logger.LogLevelDebug
+		conn, err := dialer.Dial("ws://127.0.0.1:10086/proxy", "12345", "tcp", "127.0.0.1:10096")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("333"))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		var list []protocol.TunnelInfo
+		_, err = request(http.MethodGet, "/tunnels", "admin", &list)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if len(list) != 1 || list[0].Target != "127.0.0.1:10096" || list[0].Sent != 3 || list[0].Received != 3 {
+			errCh <- fmt.Errorf("unexpected tunnels: %+v", list)
+			return
+		}
+
+		status, err = request(http.MethodPost, "/tunnels/close?id="+list[0].Id, "admin", nil)
+		if err != nil || status != http.StatusOK {
+			errCh <- fmt.Errorf("close tunnel: %d %v", status, err)
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(buf)
+		var netErr net.Error
+		if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+			errCh <- errors.New("tunnel is not closed")
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		status, err = request(http.MethodPost, "/tunnels/close?id="+list[0].Id, "admin", nil)
+		if err != nil || status != http.StatusNotFound {
+			errCh <- fmt.Errorf("close closed tunnel: %d %v", status, err)
+			return
+		}
+
+		status, err = request(http.MethodGet, "/runtime", "admin", nil)
+		if err != nil || status != http.StatusOK {
+			errCh <- fmt.Errorf("runtime: %d %v", status, err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	bans, err := serverhelper.NewBanList("")
+	if err != nil {
+		t.Fatalf("new ban list failure: %v", err)
+	}
+	bans.SetPolicy(1, time.Minute, time.Minute, time.Hour)
+	bans.Failure("1.2.3.4")
+	a := newAdminHandler("admin", protocol.NewTunnels(), bans)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("GET", "/bans")
+	var list []serverhelper.Ban
+	err = json.Unmarshal(w.Body.Bytes(), &list)
+	if err != nil || len(list) != 1 || list[0].IP != "1.2.3.4" {
+		t.Fatalf("unexpected bans: %v %s", err, w.Body.String())
+	}
+
+	w = do("POST", "/bans/unban?ip=1.2.3.4")
+	if w.Code != http.StatusOK || bans.Banned("1.2.3.4") {
+		t.Fatalf("unban failure: %d %s", w.Code, w.Body.String())
+	}
+	w = do("POST", "/bans/unban?ip=1.2.3.4")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+func TestAdminUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	l, err := listenAdmin(adminUnixPrefix + path)
+	if err != nil {
+		t.Fatalf("listen failure: %v", err)
+	}
+	defer l.Close()
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failure: %v", err)
+	}
+	if stat.Mode()&os.ModeSocket == 0 || stat.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode: %v", stat.Mode())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("temporary files left: %v", entries)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial failure: %v", err)
+	}
+	conn.Close()
+}
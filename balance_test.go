@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+	"weisuo/pool"
+	"weisuo/protocol"
+)
+
+func TestBalancedPool(t *testing.T) {
+	errCh := make(chan error)
+	// serve counts requests with targets, health checks are not counted
+	serve := func(addr string, count *int32) {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			if target != "" {
+				atomic.AddInt32(count, 1)
+			}
+			return "", auth == "12345"
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe(addr, mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}
+	var countA, countB int32
+	go serve("127.0.0.1:10170", &countA)
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10172")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	endpointA := pool.Endpoint{Proxy: "ws://127.0.0.1:10170/proxy", Auth: "12345", Dialer: protocol.DefaultDialer()}
+	endpointB := pool.Endpoint{Proxy: "ws://127.0.0.1:10171/proxy", Auth: "12345", Dialer: protocol.DefaultDialer()}
+	dial := func(p *pool.Pool) error {
+		conn, err := p.Dial("tcp", "127.0.0.1:10172")
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	go func() {
+		// B is down, so A is used though it's the second
+		p := pool.MakeBalancedPool([]pool.Endpoint{endpointB, endpointA},
+			pool.BalanceOptions{Policy: pool.PolicyFailover, CheckInterval: 300 * time.Millisecond})
+		defer p.Close()
+		err := dial(p)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if atomic.LoadInt32(&countA) != 1 {
+			t.Errorf("not failed over to A")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if s := p.Endpoints(); s[0].Healthy || !s[1].Healthy || s[1].RTT <= 0 {
+			t.Errorf("unexpected health: %+v", s)
+		}
+
+		// B is back, and preferred
+		go serve("127.0.0.1:10171", &countB)
+		time.Sleep(time.Second)
+		if s := p.Endpoints(); !s[0].Healthy {
+			t.Errorf("B not recovered: %+v", s)
+		}
+		err = dial(p)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if atomic.LoadInt32(&countB) != 1 {
+			t.Errorf("B not preferred")
+		}
+
+		// requests are spread by weights
+		endpointA.Weight = 2
+		rr := pool.MakeBalancedPool([]pool.Endpoint{endpointA, endpointB}, pool.BalanceOptions{})
+		defer rr.Close()
+		a, b := atomic.LoadInt32(&countA), atomic.LoadInt32(&countB)
+		for i := 0; i < 6; i++ {
+			err = dial(rr)
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+		if n := atomic.LoadInt32(&countA) - a; n != 4 {
+			t.Errorf("unexpected requests to A: %d", n)
+		}
+		if n := atomic.LoadInt32(&countB) - b; n != 2 {
+			t.Errorf("unexpected requests to B: %d", n)
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
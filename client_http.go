@@ -7,15 +7,14 @@ import (
 	"net"
 	"net/http"
 	"sync"
-	"weisuo/logger"
-	"weisuo/pool"
-	"weisuo/protocol"
+	"weisuo/ratelimit"
 )
 
 type HttpProxyServer struct {
 	server *http.Server
 	hc     *http.Client
-	pool   *pool.Pool
+	pool   *clientPool
+	conns  *connTracker
 }
 
 type remoteAddrMarker struct{}
@@ -23,15 +22,16 @@ type remoteAddrMarker struct{}
 var remoteAddrKey = &remoteAddrMarker{}
 
 func runClientHttp() {
-	dialer := protocol.DefaultDialer()
-	dialer.LogLevel = logger.GetLevel(cfg.LogLevel)
-	dialer.WsDialer.NetDialContext = getClientResolverDialer()
+	dialer, err := makeClientDialer(&cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	s := &HttpProxyServer{}
 	s.server = &http.Server{
 		Addr: cfg.Listen,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Println(r.Method, r.RequestURI)
+			logInfof("%s %s", r.Method, logRequestURI(r))
 			if r.Method == http.MethodConnect {
 				s.handleConnect(w, r)
 			} else {
@@ -39,18 +39,38 @@ func runClientHttp() {
 			}
 		}),
 	}
-	s.pool = pool.MakePool(cfg.Endpoint, cfg.Key, cfg.ClientPool, dialer)
+	s.pool = newClientPool(makeClientPool(&cfg, dialer))
 	s.hc = s.makeHttpClient()
+	s.conns = newConnTracker()
+
+	go func() {
+		err := s.server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatalf("client http failure: %v", err)
+		}
+	}()
 
-	err := s.server.ListenAndServe()
-	log.Fatalf("client http failure: %v", err)
+	ctx, cancel := waitForShutdown(s.pool.reload)
+	defer cancel()
+	logInfof("shutting down, draining connections")
+	shutdownCh := make(chan error, 1)
+	go func() {
+		shutdownCh <- s.server.Shutdown(ctx)
+	}()
+	s.pool.get().Drain()
+	n := s.conns.drain(ctx)
+	if err := <-shutdownCh; err != nil {
+		s.server.Close()
+	}
+	s.pool.get().Close()
+	logInfof("client shutdown, %d connections closed forcibly", n)
 }
 
 func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, req *http.Request) {
-	dstConn, err := s.pool.Dial("tcp", req.Host)
+	dstConn, err := s.pool.get().DialContext(req.Context(), "tcp", req.Host)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
-		log.Printf("[CONNECT %s => %s] server request err: %v", req.RemoteAddr, req.Host, err)
+		logErrorf("[CONNECT %s => %s] server request err: %s", req.RemoteAddr, logTarget(req.Host), logError(err, req.Host))
 		return
 	}
 	defer dstConn.Close()
@@ -58,20 +78,26 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, req *http.Request
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
-		log.Printf("[CONNECT %s => %s] unexpected err: cannot hijack", req.RemoteAddr, req.Host)
+		logErrorf("[CONNECT %s => %s] unexpected err: cannot hijack", req.RemoteAddr, logTarget(req.Host))
 		return
 	}
 	clientConn, _, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, "Internal error", http.StatusServiceUnavailable)
-		log.Printf("[CONNECT %s => %s] unexpected err: failed to hijack, err: %v", req.RemoteAddr, req.Host, err)
+		logErrorf("[CONNECT %s => %s] unexpected err: failed to hijack, err: %v", req.RemoteAddr, logTarget(req.Host), err)
 		return
 	}
 	defer clientConn.Close()
+	untrack, ok := s.conns.add(clientConn, dstConn)
+	if !ok {
+		return
+	}
+	defer untrack()
 
-	log.Printf("[CONNECT %s => %s] connected", req.RemoteAddr, req.Host)
+	logInfof("[CONNECT %s => %s] connected", req.RemoteAddr, logTarget(req.Host))
 	clientConn.Write([]byte(req.Proto + " 200 OK\r\n\r\n"))
 
+	upload, download := shaping.limiters("")
 	var wg sync.WaitGroup
 	var sent, received int64
 	wg.Add(2)
@@ -79,9 +105,9 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, req *http.Request
 		defer wg.Done()
 		defer dstConn.CloseWrite()
 		var err error
-		sent, err = io.Copy(dstConn, clientConn)
+		sent, err = io.Copy(ratelimit.NewWriter(dstConn, upload...), clientConn)
 		if err != nil {
-			log.Printf("[CONNECT %s => %s] err 1: %v", req.RemoteAddr, req.Host, err)
+			logErrorf("[CONNECT %s => %s] err 1: %v", req.RemoteAddr, logTarget(req.Host), err)
 		}
 	}()
 	go func() {
@@ -89,13 +115,13 @@ func (s *HttpProxyServer) handleConnect(w http.ResponseWriter, req *http.Request
 		defer clientConn.(*net.TCPConn).CloseWrite()
 		var err error
 		if err != nil {
-			log.Printf("[CONNECT %s => %s] err 2: %v", req.RemoteAddr, req.Host, err)
+			logErrorf("[CONNECT %s => %s] err 2: %v", req.RemoteAddr, logTarget(req.Host), err)
 		}
-		received, err = io.Copy(clientConn, dstConn)
+		received, err = io.Copy(ratelimit.NewWriter(clientConn, download...), dstConn)
 	}()
 
 	wg.Wait()
-	log.Printf("[CONNECT %s => %s] disconnect, sent %d received %d", req.RemoteAddr, req.Host, sent, received)
+	logInfof("[CONNECT %s => %s] disconnect, sent %d received %d", req.RemoteAddr, logTarget(req.Host), sent, received)
 }
 
 func (s *HttpProxyServer) makeHttpClient() *http.Client {
@@ -103,12 +129,12 @@ func (s *HttpProxyServer) makeHttpClient() *http.Client {
 		Transport: &http.Transport{
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 				remoteAddr := ctx.Value(remoteAddrKey).(string)
-				conn, err := s.pool.Dial(network, addr)
+				conn, err := s.pool.get().DialContext(ctx, network, addr)
 				if err != nil {
-					log.Println("server request err:", remoteAddr, addr, err)
+					logErrorf("server request err: %s %s %s", remoteAddr, logTarget(addr), logError(err, addr))
 					return nil, err
 				}
-				log.Printf("[PROXY %s => %s] connected", remoteAddr, addr)
+				logInfof("[PROXY %s => %s] connected", remoteAddr, logTarget(addr))
 				return conn, nil
 			},
 			DisableKeepAlives: true,
@@ -123,7 +149,7 @@ func (s *HttpProxyServer) makeHttpClient() *http.Client {
 func (s *HttpProxyServer) handleHttp(w http.ResponseWriter, req *http.Request) {
 	newReq, err := http.NewRequest(req.Method, req.RequestURI, req.Body)
 	if err != nil {
-		log.Println("http.NewRequest err:", req, err.Error())
+		logErrorf("http.NewRequest err: %s %s", logRequestURI(req), err.Error())
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -137,7 +163,7 @@ func (s *HttpProxyServer) handleHttp(w http.ResponseWriter, req *http.Request) {
 	ctx := context.WithValue(context.Background(), remoteAddrKey, req.RemoteAddr)
 	resp, err := s.hc.Do(newReq.WithContext(ctx))
 	if err != nil {
-		log.Println("httpClient.Do err:", err.Error())
+		logErrorf("httpClient.Do err: %s", logError(err, req.Host))
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
@@ -149,9 +175,10 @@ func (s *HttpProxyServer) handleHttp(w http.ResponseWriter, req *http.Request) {
 	}
 
 	w.WriteHeader(resp.StatusCode)
-	countRecv, _ := io.Copy(w, resp.Body)
+	_, download := shaping.limiters("")
+	countRecv, _ := io.Copy(ratelimit.NewWriter(w, download...), resp.Body)
 
 	// TODO accurate number
 
-	log.Printf("[PROXY %s => %s] disconnected, received %d", req.RemoteAddr, req.Host, countRecv)
+	logInfof("[PROXY %s => %s] disconnected, received %d", req.RemoteAddr, logTarget(req.Host), countRecv)
 }
@@ -2,26 +2,43 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/url"
+	"sync/atomic"
+	"time"
+	"weisuo/edge"
+	"weisuo/logger"
+	"weisuo/pool"
+	"weisuo/protocol"
+	"weisuo/token"
 )
 
-func getClientResolverDialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
-	if cfg.ClientResolver == "" {
-		return nil
-	}
-
-	u, err := url.Parse(cfg.ClientResolver)
+func parseClientResolver(resolver string) (*url.URL, error) {
+	u, err := url.Parse(resolver)
 	if err != nil {
-		log.Fatalf("cannot parse value of client_resolver: %v", err)
+		return nil, fmt.Errorf("cannot parse value of client_resolver: %v", err)
 	}
 
 	switch u.Scheme {
 	case "udp":
 	case "tcp":
 	default:
-		log.Fatalf("Supported schemes of client_resolver: udp, tcp. Got %s", u.Scheme)
+		return nil, fmt.Errorf("Supported schemes of client_resolver: udp, tcp. Got %s", u.Scheme)
+	}
+	return u, nil
+}
+
+func getClientResolverDialer(c *Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.ClientResolver == "" {
+		return nil
+	}
+
+	u, err := parseClientResolver(c.ClientResolver)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
 	resolverDialer := &net.Dialer{}
@@ -39,3 +56,187 @@ func getClientResolverDialer() func(ctx context.Context, network, addr string) (
 		return dialer.DialContext(ctx, network, addr)
 	}
 }
+
+// HeartbeatConfig schedules pings and keepalive messages to the endpoint, in seconds
+type HeartbeatConfig struct {
+	PingInterval      uint `json:"ping_interval"`
+	PingJitter        uint `json:"ping_jitter"`
+	KeepaliveInterval uint `json:"keepalive_interval"`
+}
+
+// heartbeat returns the default heartbeat if c is nil, the jitter is a fifth of the interval by default
+func (c *HeartbeatConfig) heartbeat() protocol.Heartbeat {
+	hb := protocol.DefaultHeartbeat()
+	if c == nil {
+		return hb
+	}
+	if c.PingInterval > 0 {
+		hb.PingInterval = time.Duration(c.PingInterval) * time.Second
+		hb.Jitter = hb.PingInterval / 5
+	}
+	if c.PingJitter > 0 {
+		hb.Jitter = time.Duration(c.PingJitter) * time.Second
+	}
+	hb.KeepaliveInterval = time.Duration(c.KeepaliveInterval) * time.Second
+	return hb
+}
+
+func makeClientDialer(c *Config) (*protocol.Dialer, error) {
+	l, err := makeLogger(c)
+	if err != nil {
+		return nil, err
+	}
+	dialer := protocol.DefaultDialer()
+	dialer.Logger = l
+	dialer.LogLevel = logger.GetLevel(c.LogLevel)
+	dialer.LogTarget = makeLogTarget(c)
+	dialer.WsDialer.NetDialContext = getClientResolverDialer(c)
+	if c.AuthScheme == authSchemeHmac {
+		dialer.AuthSigner = token.Sign
+	}
+	if c.ClientMaxPongMisses > 0 {
+		dialer.MaxPongMisses = int(c.ClientMaxPongMisses)
+	}
+	dialer.Heartbeat = c.Heartbeat.heartbeat()
+	return dialer, nil
+}
+
+// EndpointConfig is one of endpoints of a client, key and heartbeat are the top level ones if not specified
+type EndpointConfig struct {
+	Endpoint  string           `json:"endpoint"`
+	Key       string           `json:"key"`
+	Weight    uint             `json:"weight"`
+	Heartbeat *HeartbeatConfig `json:"heartbeat"`
+	Edge      *EdgeConfig      `json:"edge"`
+}
+
+// EdgeConfig pins connections to the best edge IPs of the endpoint, which are probed in the background
+type EdgeConfig struct {
+	Candidates    []string `json:"candidates"`
+	Pin           uint     `json:"pin"`
+	ProbeInterval uint     `json:"probe_interval"`
+	MaxProbes     uint     `json:"max_probes"`
+}
+
+func (c *EdgeConfig) check() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Candidates) == 0 {
+		return errors.New("candidates of edge is required")
+	}
+	_, err := edge.ParseCandidates(c.Candidates)
+	return err
+}
+
+// edgeOptimizers are of the current pool, they are stopped once the pool is replaced
+var edgeOptimizers []*edge.Optimizer
+
+// pinEdge makes the dialer dial the best edges of the endpoint
+func pinEdge(dialer *protocol.Dialer, endpoint, key string, c *EdgeConfig) {
+	candidates, _ := edge.ParseCandidates(c.Candidates)
+	o, err := edge.NewOptimizer(endpoint, key, dialer, candidates, edge.Options{
+		Pin:       int(c.Pin),
+		Interval:  time.Duration(c.ProbeInterval) * time.Second,
+		MaxProbes: int(c.MaxProbes),
+	})
+	if err != nil {
+		logErrorf("edge optimizer failure: %v", err)
+		return
+	}
+	dialer.WsDialer.NetDialContext = o.DialContext
+	o.Start()
+	edgeOptimizers = append(edgeOptimizers, o)
+}
+
+// makeClientPool makes the pool of c, edge optimizers of the previous pool are stopped
+func makeClientPool(c *Config, dialer *protocol.Dialer) *pool.Pool {
+	previous := edgeOptimizers
+	edgeOptimizers = nil
+	p := newPool(c, dialer)
+	// the previous pool keeps dialing the edges pinned last
+	for _, o := range previous {
+		o.Stop()
+	}
+	return p
+}
+
+func newPool(c *Config, dialer *protocol.Dialer) *pool.Pool {
+	idle := pool.Options{
+		MinIdle:    int(c.ClientPool),
+		MaxIdle:    int(c.ClientPoolMax),
+		MaxIdleAge: time.Duration(c.ClientPoolMaxIdleAge) * time.Second,
+	}
+	if len(c.Endpoints) > 0 {
+		return makeBalancedPool(c, dialer, idle)
+	}
+	if c.Edge != nil {
+		pinEdge(dialer, c.Endpoint, c.Key, c.Edge)
+	}
+	if c.ClientMux {
+		return pool.MakeMuxPool(c.Endpoint, c.Key, dialer)
+	}
+	if c.ClientPoolMax > 0 || c.ClientPoolMaxIdleAge > 0 {
+		return pool.MakeAdaptivePool(c.Endpoint, c.Key, idle, dialer)
+	}
+	return pool.MakePool(c.Endpoint, c.Key, c.ClientPool, dialer)
+}
+
+// makeBalancedPool makes a pool of endpoints, each of which has a copy of the dialer
+func makeBalancedPool(c *Config, dialer *protocol.Dialer, idle pool.Options) *pool.Pool {
+	var endpoints []pool.Endpoint
+	for _, e := range c.Endpoints {
+		d := *dialer
+		wsDialer := *dialer.WsDialer
+		d.WsDialer = &wsDialer
+		if e.Heartbeat != nil {
+			d.Heartbeat = e.Heartbeat.heartbeat()
+		}
+		key := e.Key
+		if key == "" {
+			key = c.Key
+		}
+		if e.Edge != nil {
+			pinEdge(&d, e.Endpoint, key, e.Edge)
+		}
+		endpoints = append(endpoints, pool.Endpoint{
+			Proxy:  e.Endpoint,
+			Auth:   key,
+			Weight: int(e.Weight),
+			Dialer: &d,
+		})
+	}
+	return pool.MakeBalancedPool(endpoints, pool.BalanceOptions{
+		Policy:        c.EndpointPolicy,
+		CheckInterval: time.Duration(c.EndpointCheckInterval) * time.Second,
+		Mux:           c.ClientMux,
+		Idle:          idle,
+	})
+}
+
+// clientPool holds the pool of a client, which is replaced on reload
+type clientPool struct {
+	v atomic.Value // *pool.Pool
+}
+
+func newClientPool(p *pool.Pool) *clientPool {
+	c := &clientPool{}
+	c.v.Store(p)
+	return c
+}
+
+func (c *clientPool) get() *pool.Pool {
+	return c.v.Load().(*pool.Pool)
+}
+
+// reload replaces the pool with a new one made by conf, connections in use are kept, idle ones are closed
+func (c *clientPool) reload(conf *Config) error {
+	dialer, err := makeClientDialer(conf)
+	if err != nil {
+		return err
+	}
+	old := c.get()
+	c.v.Store(makeClientPool(conf, dialer))
+	old.Drain()
+	return nil
+}
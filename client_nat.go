@@ -8,22 +8,23 @@ import (
 	"net"
 	"sync"
 	"syscall"
-	"weisuo/logger"
-	"weisuo/pool"
-	"weisuo/protocol"
+	"weisuo/ratelimit"
 )
 
 type NatServer struct {
-	pool *pool.Pool
+	pool  *clientPool
+	conns *connTracker
 }
 
 func runClientNat() {
-	dialer := protocol.DefaultDialer()
-	dialer.LogLevel = logger.GetLevel(cfg.LogLevel)
-	dialer.WsDialer.NetDialContext = getClientResolverDialer()
+	dialer, err := makeClientDialer(&cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	s := &NatServer{
-		pool: pool.MakePool(cfg.Endpoint, cfg.Key, cfg.ClientPool, dialer),
+		pool:  newClientPool(makeClientPool(&cfg, dialer)),
+		conns: newConnTracker(),
 	}
 
 	listener, err := net.Listen("tcp", cfg.Listen)
@@ -31,14 +32,28 @@ func runClientNat() {
 		log.Fatalf("client nat listen failure: %v", err)
 	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Fatalf("client nat accept failure: %v", err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Fatalf("client nat accept failure: %v", err)
+			}
+
+			go s.handleConn(conn)
 		}
+	}()
 
-		go s.handleConn(conn)
-	}
+	ctx, cancel := waitForShutdown(s.pool.reload)
+	defer cancel()
+	logInfof("shutting down, draining connections")
+	listener.Close()
+	s.pool.get().Drain()
+	n := s.conns.drain(ctx)
+	s.pool.get().Close()
+	logInfof("client shutdown, %d connections closed forcibly", n)
 }
 
 // https://gist.github.com/fangdingjun/11e5d63abe9284dc0255a574a76bbcb1
@@ -80,35 +95,42 @@ func getTcpConnOrigDst(conn net.Conn) (*net.TCPConn, net.IP, uint16, error) {
 func (s *NatServer) handleConn(clientConn net.Conn) {
 	clientTcpConn, host, port, err := getTcpConnOrigDst(clientConn)
 	if err != nil {
-		log.Printf("[NAT %s => NIL] failed to get orig dst addr: %v", clientConn.RemoteAddr(), err)
+		logErrorf("[NAT %s => NIL] failed to get orig dst addr: %v", clientConn.RemoteAddr(), err)
 		return
 	}
 	defer clientTcpConn.Close()
 
-	log.Printf("[NAT %s => %s:%d] incoming", clientTcpConn.RemoteAddr(), host, port)
+	target := fmt.Sprintf("%s:%d", host, port)
+	logInfof("[NAT %s => %s] incoming", clientTcpConn.RemoteAddr(), logTarget(target))
 
-	dstConn, err := s.pool.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	dstConn, err := s.pool.get().Dial("tcp", target)
 	if err != nil {
-		log.Printf("[NAT %s => %s:%d] weisuo request err: %v", clientTcpConn.RemoteAddr(), host, port, err)
+		logErrorf("[NAT %s => %s] weisuo request err: %s", clientTcpConn.RemoteAddr(), logTarget(target), logError(err, target))
 		return
 	}
 	defer dstConn.Close()
-	log.Printf("[NAT %s => %s:%d] connected", clientConn.RemoteAddr(), host, port)
+	untrack, ok := s.conns.add(clientTcpConn, dstConn)
+	if !ok {
+		return
+	}
+	defer untrack()
+	logInfof("[NAT %s => %s] connected", clientConn.RemoteAddr(), logTarget(target))
 
+	upload, download := shaping.limiters("")
 	var wg sync.WaitGroup
 	var sent, received int64
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer dstConn.CloseWrite()
-		sent, _ = io.Copy(dstConn, clientTcpConn)
+		sent, _ = io.Copy(ratelimit.NewWriter(dstConn, upload...), clientTcpConn)
 	}()
 	go func() {
 		defer wg.Done()
 		defer clientTcpConn.CloseWrite()
-		received, _ = io.Copy(clientTcpConn, dstConn)
+		received, _ = io.Copy(ratelimit.NewWriter(clientTcpConn, download...), dstConn)
 	}()
 
 	wg.Wait()
-	log.Printf("[NAT %s => %s:%d] disconnect, sent %d received %d", clientTcpConn.RemoteAddr(), host, port, sent, received)
+	logInfof("[NAT %s => %s] disconnect, sent %d received %d", clientTcpConn.RemoteAddr(), logTarget(target), sent, received)
 }
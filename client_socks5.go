@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"weisuo/protocol"
+	"weisuo/ratelimit"
+)
+
+const (
+	socks4Version = 4
+	socks5Version = 5
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5RepSucceeded          = 0x00
+	socks5RepFailure            = 0x01
+	socks5RepNotAllowed         = 0x02
+	socks5RepNetUnreachable     = 0x03
+	socks5RepHostUnreachable    = 0x04
+	socks5RepRefused            = 0x05
+	socks5RepTTLExpired         = 0x06
+	socks5RepCmdNotSupported    = 0x07
+	socks5RepAddrTypeNotSupport = 0x08
+
+	socks4RepGranted  = 0x5a
+	socks4RepRejected = 0x5b
+
+	// socksHandshakeTimeout is how long a client may take to send its request
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+type Socks5Server struct {
+	pool     *clientPool
+	username string
+	password string
+	conns    *connTracker
+}
+
+func runClientSocks5() {
+	dialer, err := makeClientDialer(&cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	s := &Socks5Server{
+		pool:     newClientPool(makeClientPool(&cfg, dialer)),
+		username: cfg.Socks5Username,
+		password: cfg.Socks5Password,
+		conns:    newConnTracker(),
+	}
+
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.Fatalf("client socks5 listen failure: %v", err)
+	}
+
+	go func() {
+		err := s.serve(listener)
+		if !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("client socks5 accept failure: %v", err)
+		}
+	}()
+
+	ctx, cancel := waitForShutdown(s.pool.reload)
+	defer cancel()
+	logInfof("shutting down, draining connections")
+	listener.Close()
+	s.pool.get().Drain()
+	n := s.conns.drain(ctx)
+	s.pool.get().Close()
+	logInfof("client shutdown, %d connections closed forcibly", n)
+}
+
+func (s *Socks5Server) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Socks5Server) handleConn(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	_ = clientConn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(clientConn, buf)
+	if err != nil {
+		logErrorf("[SOCKS %s => NIL] read version failure: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+
+	var target string
+	var reply func(err error) error
+	switch buf[0] {
+	case socks5Version:
+		target, reply, err = s.handshake5(clientConn)
+	case socks4Version:
+		target, reply, err = s.handshake4(clientConn)
+	default:
+		err = fmt.Errorf("unsupported version: %d", buf[0])
+	}
+	if err != nil {
+		logErrorf("[SOCKS %s => NIL] handshake failure: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+	// the target is dialed with its own timeout, and data is copied without deadlines
+	_ = clientConn.SetDeadline(time.Time{})
+
+	logInfof("[SOCKS %s => %s] incoming", clientConn.RemoteAddr(), logTarget(target))
+
+	dstConn, err := s.pool.get().Dial("tcp", target)
+	if err != nil {
+		logErrorf("[SOCKS %s => %s] weisuo request err: %s", clientConn.RemoteAddr(), logTarget(target), logError(err, target))
+		_ = reply(err)
+		return
+	}
+	defer dstConn.Close()
+	untrack, ok := s.conns.add(clientConn, dstConn)
+	if !ok {
+		_ = reply(errors.New("shutting down"))
+		return
+	}
+	defer untrack()
+
+	err = reply(nil)
+	if err != nil {
+		logErrorf("[SOCKS %s => %s] reply failure: %v", clientConn.RemoteAddr(), logTarget(target), err)
+		return
+	}
+	logInfof("[SOCKS %s => %s] connected", clientConn.RemoteAddr(), logTarget(target))
+
+	upload, download := shaping.limiters("")
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer dstConn.CloseWrite()
+		sent, _ = io.Copy(ratelimit.NewWriter(dstConn, upload...), clientConn)
+	}()
+	go func() {
+		defer wg.Done()
+		defer clientConn.(*net.TCPConn).CloseWrite()
+		received, _ = io.Copy(ratelimit.NewWriter(clientConn, download...), dstConn)
+	}()
+
+	wg.Wait()
+	logInfof("[SOCKS %s => %s] disconnect, sent %d received %d", clientConn.RemoteAddr(), logTarget(target), sent, received)
+}
+
+// handshake5 handles a SOCKS5 request after the version byte, returns the target and the function to reply
+func (s *Socks5Server) handshake5(conn net.Conn) (string, func(error) error, error) {
+	buf := make([]byte, 255)
+
+	// methods
+	_, err := io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return "", nil, err
+	}
+	methods := buf[:buf[0]]
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", nil, err
+	}
+
+	method := byte(socks5AuthNone)
+	if s.username != "" {
+		method = socks5AuthPassword
+	}
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+			break
+		}
+	}
+	if !found {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", nil, errors.New("no acceptable auth method")
+	}
+	_, err = conn.Write([]byte{socks5Version, method})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if method == socks5AuthPassword {
+		err = s.auth5(conn)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	// request
+	_, err = io.ReadFull(conn, buf[:4])
+	if err != nil {
+		return "", nil, err
+	}
+	if buf[0] != socks5Version {
+		return "", nil, fmt.Errorf("unexpected version of request: %d", buf[0])
+	}
+	cmd, addrType := buf[1], buf[3]
+
+	var host string
+	switch addrType {
+	case socks5AddrIPv4:
+		_, err = io.ReadFull(conn, buf[:net.IPv4len])
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socks5AddrIPv6:
+		_, err = io.ReadFull(conn, buf[:net.IPv6len])
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socks5AddrDomain:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err == nil {
+			l := int(buf[0])
+			_, err = io.ReadFull(conn, buf[:l])
+			host = string(buf[:l])
+		}
+	default:
+		_ = writeReply5(conn, socks5RepAddrTypeNotSupport)
+		return "", nil, fmt.Errorf("unsupported address type: %d", addrType)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return "", nil, err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	if cmd != socksCmdConnect {
+		_ = writeReply5(conn, socks5RepCmdNotSupported)
+		return "", nil, fmt.Errorf("unsupported command: %d", cmd)
+	}
+
+	reply := func(err error) error {
+		if err != nil {
+			return writeReply5(conn, socks5ReplyCode(err))
+		}
+		return writeReply5(conn, socks5RepSucceeded)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), reply, nil
+}
+
+// auth5 handles username/password authentication, RFC 1929
+func (s *Socks5Server) auth5(conn net.Conn) error {
+	buf := make([]byte, 255)
+
+	_, err := io.ReadFull(conn, buf[:2])
+	if err != nil {
+		return err
+	}
+	if buf[0] != 1 {
+		return fmt.Errorf("unexpected version of auth: %d", buf[0])
+	}
+	username := make([]byte, buf[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(conn, buf[:1])
+	if err != nil {
+		return err
+	}
+	password := make([]byte, buf[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return err
+	}
+
+	usernameOk := subtle.ConstantTimeCompare(username, []byte(s.username)) == 1
+	passwordOk := subtle.ConstantTimeCompare(password, []byte(s.password)) == 1
+	if !usernameOk || !passwordOk {
+		_, _ = conn.Write([]byte{1, 1})
+		return fmt.Errorf("invalid credentials of user %s", username)
+	}
+
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+func writeReply5(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func socks5ReplyCode(err error) byte {
+	switch protocol.ErrorCode(err) {
+	case protocol.ErrorCodeNotAllowed:
+		return socks5RepNotAllowed
+	case protocol.ErrorCodeNetUnreachable:
+		return socks5RepNetUnreachable
+	case protocol.ErrorCodeHostUnreachable, protocol.ErrorCodeTimeout:
+		// a connect timeout means the host is unreachable, TTL expired is about routing
+		return socks5RepHostUnreachable
+	case protocol.ErrorCodeRefused:
+		return socks5RepRefused
+	}
+	return socks5RepFailure
+}
+
+// handshake4 handles a SOCKS4 or SOCKS4a request after the version byte
+func (s *Socks5Server) handshake4(conn net.Conn) (string, func(error) error, error) {
+	buf := make([]byte, 7)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := buf[0]
+	port := binary.BigEndian.Uint16(buf[1:3])
+	ip := net.IP(buf[3:7])
+
+	_, err = readNullTerminated(conn)
+	if err != nil {
+		return "", nil, err
+	}
+
+	host := ip.String()
+	// SOCKS4a: 0.0.0.x, followed by the domain name
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readNullTerminated(conn)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if s.username != "" {
+		_ = writeReply4(conn, socks4RepRejected)
+		return "", nil, errors.New("SOCKS4 is not allowed if authentication is required")
+	}
+	if cmd != socksCmdConnect {
+		_ = writeReply4(conn, socks4RepRejected)
+		return "", nil, fmt.Errorf("unsupported command: %d", cmd)
+	}
+
+	reply := func(err error) error {
+		if err != nil {
+			return writeReply4(conn, socks4RepRejected)
+		}
+		return writeReply4(conn, socks4RepGranted)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), reply, nil
+}
+
+func readNullTerminated(conn net.Conn) (string, error) {
+	var result []byte
+	buf := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			return "", err
+		}
+		if buf[0] == 0 {
+			return string(result), nil
+		}
+		if len(result) >= 255 {
+			return "", errors.New("string too long")
+		}
+		result = append(result, buf[0])
+	}
+}
+
+func writeReply4(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{0, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,72 @@
+package edge
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+)
+
+// ParseCandidates parses IPs and CIDRs of edges, an IP is taken as a single address network
+func ParseCandidates(list []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid edge cidr: %s", s)
+			}
+			ret = append(ret, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid edge ip: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+	}
+	return ret, nil
+}
+
+// sample returns at most n addresses of the candidates, single addresses are all taken first,
+// and the rest are random ones spread over networks
+func sample(candidates []*net.IPNet, n int) []net.IP {
+	seen := make(map[string]bool)
+	var ret []net.IP
+	add := func(ip net.IP) {
+		if len(ret) < n && !seen[ip.String()] {
+			seen[ip.String()] = true
+			ret = append(ret, ip)
+		}
+	}
+
+	var networks []*net.IPNet
+	for _, c := range candidates {
+		if ones, bits := c.Mask.Size(); ones == bits {
+			add(c.IP)
+		} else {
+			networks = append(networks, c)
+		}
+	}
+	if len(networks) == 0 {
+		return ret
+	}
+	// duplicates are skipped, so try a few more times than needed
+	for i := 0; len(ret) < n && i < n*4; i++ {
+		add(randomIP(networks[i%len(networks)]))
+	}
+	return ret
+}
+
+// randomIP returns a random address in the network
+func randomIP(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	for i := range ip {
+		ip[i] = n.IP[i]&n.Mask[i] | byte(rand.Intn(256))&^n.Mask[i]
+	}
+	return ip
+}
@@ -0,0 +1,53 @@
+package edge
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCandidates(t *testing.T) {
+	candidates, err := ParseCandidates([]string{"104.16.0.1", "172.64.0.0/24", "2606:4700::/120"})
+	if err != nil {
+		t.Fatalf("parse failure: %v", err)
+	}
+	if len(candidates) != 3 {
+		t.Fatalf("unexpected candidates: %v", candidates)
+	}
+	if ones, bits := candidates[0].Mask.Size(); ones != 32 || bits != 32 {
+		t.Fatalf("unexpected mask of an ip: %v", candidates[0])
+	}
+
+	for _, s := range []string{"104.16.0", "172.64.0.0/33", "example.com"} {
+		_, err = ParseCandidates([]string{s})
+		if err == nil {
+			t.Fatalf("invalid candidate accepted: %s", s)
+		}
+	}
+
+	ips := sample(candidates, 10)
+	if len(ips) != 10 {
+		t.Fatalf("unexpected number of samples: %v", ips)
+	}
+	if !ips[0].Equal(net.ParseIP("104.16.0.1")) {
+		t.Fatalf("single ip not taken first: %v", ips)
+	}
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		if seen[ip.String()] {
+			t.Fatalf("duplicate sample: %v", ips)
+		}
+		seen[ip.String()] = true
+		found := false
+		for _, c := range candidates {
+			found = found || c.Contains(ip)
+		}
+		if !found {
+			t.Fatalf("sample out of candidates: %v", ip)
+		}
+	}
+
+	ips = sample(candidates[:1], 10)
+	if len(ips) != 1 {
+		t.Fatalf("unexpected samples of a single ip: %v", ips)
+	}
+}
@@ -0,0 +1,318 @@
+package edge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+)
+
+const (
+	defaultPin       = 3
+	defaultInterval  = 10 * time.Minute
+	defaultMaxProbes = 32
+	defaultSamples   = 3
+	defaultTimeout   = 5 * time.Second
+	probeConcurrency = 8
+	// minDialTimeout is the least timeout of dialing an edge, whatever its handshake time is
+	minDialTimeout = 500 * time.Millisecond
+)
+
+// Options of an optimizer, zero values are replaced by defaults
+type Options struct {
+	// Pin is the number of the best edges dialed
+	Pin int
+	// Interval of probing
+	Interval time.Duration
+	// MaxProbes is the number of addresses probed each time, addresses of CIDRs are sampled randomly
+	MaxProbes int
+	// Samples is the number of probes of each address, failed ones count as loss
+	Samples int
+	// Timeout of each probe
+	Timeout time.Duration
+}
+
+// Result of probing an edge
+type Result struct {
+	IP net.IP
+	// Handshake is the average time of TCP, TLS and WebSocket handshakes
+	Handshake time.Duration
+	// RTT is the average round-trip time of pings
+	RTT  time.Duration
+	Loss float64
+}
+
+// less ranks results by loss, and then by latency
+func (r Result) less(o Result) bool {
+	if r.Loss != o.Loss {
+		return r.Loss < o.Loss
+	}
+	return r.Handshake+r.RTT < o.Handshake+o.RTT
+}
+
+// Optimizer probes candidate edge IPs of an endpoint in the background, and dials the best ones for it.
+// Only the address of TCP connections is changed, so the SNI and the Host header are still of the endpoint.
+type Optimizer struct {
+	proxy      string
+	auth       string
+	addr       string
+	port       string
+	dialer     *protocol.Dialer
+	base       func(ctx context.Context, network, addr string) (net.Conn, error)
+	netDialer  *net.Dialer
+	candidates []*net.IPNet
+	opts       Options
+
+	mutex    sync.Mutex
+	best     []Result
+	next     int
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOptimizer makes an optimizer of the endpoint proxy, dialer is used for probing and dialing other addresses.
+// Set DialContext as NetDialContext of the WebSocket dialer, and Start it.
+func NewOptimizer(proxy, auth string, dialer *protocol.Dialer, candidates []*net.IPNet, opts Options) (*Optimizer, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %v", err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no edge candidates of %s", u.Hostname())
+	}
+
+	if opts.Pin <= 0 {
+		opts.Pin = defaultPin
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultInterval
+	}
+	if opts.MaxProbes <= 0 {
+		opts.MaxProbes = defaultMaxProbes
+	}
+	if opts.Samples <= 0 {
+		opts.Samples = defaultSamples
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+
+	o := &Optimizer{
+		proxy:      proxy,
+		auth:       auth,
+		addr:       net.JoinHostPort(u.Hostname(), port),
+		port:       port,
+		dialer:     dialer,
+		base:       dialer.WsDialer.NetDialContext,
+		netDialer:  &net.Dialer{},
+		candidates: candidates,
+		opts:       opts,
+		stop:       make(chan struct{}),
+	}
+	if o.base == nil {
+		o.base = o.netDialer.DialContext
+	}
+	return o, nil
+}
+
+// Start probes periodically in the background, the endpoint is dialed as usual until the first probing finishes
+func (o *Optimizer) Start() {
+	go func() {
+		for {
+			o.probe()
+			select {
+			case <-o.stop:
+				return
+			case <-time.After(o.opts.Interval):
+			}
+		}
+	}()
+}
+
+// Stop stops probing, the best edges are still dialed
+func (o *Optimizer) Stop() {
+	o.stopOnce.Do(func() {
+		close(o.stop)
+	})
+}
+
+// Best returns the results of the edges pinned
+func (o *Optimizer) Best() []Result {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]Result(nil), o.best...)
+}
+
+// DialContext dials the best edges in turn for the endpoint, and falls back to the usual way if all fail.
+// Each edge is given a short timeout by its handshake time, and it's dropped once failed until probed again.
+func (o *Optimizer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if addr != o.addr {
+		return o.base(ctx, network, addr)
+	}
+
+	o.mutex.Lock()
+	best := o.best
+	start := o.next
+	o.next++
+	o.mutex.Unlock()
+
+	for i := range best {
+		r := best[(start+i)%len(best)]
+		dialCtx, cancel := context.WithTimeout(ctx, o.dialTimeout(r))
+		conn, err := o.netDialer.DialContext(dialCtx, network, net.JoinHostPort(r.IP.String(), o.port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		o.logWarnf("dial edge %s failure, dropped: %v", r.IP, err)
+		o.drop(r.IP)
+	}
+	return o.base(ctx, network, addr)
+}
+
+// dialTimeout returns the timeout of dialing the edge, several times its handshake time and no more than Timeout
+func (o *Optimizer) dialTimeout(r Result) time.Duration {
+	timeout := 4 * r.Handshake
+	if timeout < minDialTimeout {
+		timeout = minDialTimeout
+	}
+	if timeout > o.opts.Timeout {
+		timeout = o.opts.Timeout
+	}
+	return timeout
+}
+
+// drop unpins the edge, it's pinned again if it's still among the best when probed next time
+func (o *Optimizer) drop(ip net.IP) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	var best []Result
+	for _, r := range o.best {
+		if !r.IP.Equal(ip) {
+			best = append(best, r)
+		}
+	}
+	o.best = best
+}
+
+// probe probes sampled candidates and the edges pinned, and pins the best ones.
+// The previous ones are kept if none is reachable.
+func (o *Optimizer) probe() {
+	ips := sample(o.candidates, o.opts.MaxProbes)
+	for _, r := range o.Best() {
+		found := false
+		for _, ip := range ips {
+			found = found || ip.Equal(r.IP)
+		}
+		if !found {
+			ips = append(ips, r.IP)
+		}
+	}
+
+	results := make([]Result, len(ips))
+	sem := make(chan struct{}, probeConcurrency)
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			results[i] = o.probeIP(ip)
+			<-sem
+		}(i, ip)
+	}
+	wg.Wait()
+
+	var best []Result
+	for _, r := range results {
+		if r.Loss < 1 {
+			best = append(best, r)
+		}
+	}
+	if len(best) == 0 {
+		o.logWarnf("none of %d edges reachable, keep the previous ones", len(ips))
+		return
+	}
+	sort.SliceStable(best, func(i, j int) bool {
+		return best[i].less(best[j])
+	})
+	if len(best) > o.opts.Pin {
+		best = best[:o.opts.Pin]
+	}
+
+	o.mutex.Lock()
+	o.best = best
+	o.mutex.Unlock()
+
+	var s []string
+	for _, r := range best {
+		s = append(s, fmt.Sprintf("%s (handshake %v, rtt %v, loss %.0f%%)",
+			r.IP, r.Handshake.Round(time.Millisecond), r.RTT.Round(time.Millisecond), r.Loss*100))
+	}
+	o.logInfof("%d edges probed, pinned %s", len(ips), strings.Join(s, ", "))
+}
+
+// probeIP checks the endpoint over the address several times
+func (o *Optimizer) probeIP(ip net.IP) Result {
+	d := *o.dialer
+	wsDialer := *o.dialer.WsDialer
+	wsDialer.NetDialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return o.netDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), o.port))
+	}
+	d.WsDialer = &wsDialer
+
+	ret := Result{IP: ip}
+	n := 0
+	for i := 0; i < o.opts.Samples; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), o.opts.Timeout)
+		start := time.Now()
+		rtt, err := d.Check(ctx, o.proxy, o.auth)
+		elapsed := time.Since(start)
+		cancel()
+		if err != nil {
+			o.logDebugf("probe edge %s failure: %v", ip, err)
+			continue
+		}
+		ret.Handshake += elapsed - rtt
+		ret.RTT += rtt
+		n++
+	}
+	if n > 0 {
+		ret.Handshake /= time.Duration(n)
+		ret.RTT /= time.Duration(n)
+	}
+	ret.Loss = float64(o.opts.Samples-n) / float64(o.opts.Samples)
+	return ret
+}
+
+func (o *Optimizer) logf(level logger.LogLevel, format string, a ...interface{}) {
+	if o.dialer.Logger != nil && o.dialer.LogLevel >= level {
+		logger.Write(o.dialer.Logger, level, "EDGE "+fmt.Sprintf(format, a...))
+	}
+}
+
+func (o *Optimizer) logDebugf(format string, a ...interface{}) {
+	o.logf(logger.LogLevelDebug, format, a...)
+}
+func (o *Optimizer) logInfof(format string, a ...interface{}) {
+	o.logf(logger.LogLevelInfo, format, a...)
+}
+func (o *Optimizer) logWarnf(format string, a ...interface{}) {
+	o.logf(logger.LogLevelWarn, format, a...)
+}
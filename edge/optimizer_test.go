@@ -0,0 +1,103 @@
+package edge
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestOptimizer(t *testing.T) {
+	var mutex sync.Mutex
+	var hosts []string
+	upgrader := &websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		hosts = append(hosts, r.Host)
+		mutex.Unlock()
+
+		header := make(http.Header)
+		header.Set(protocol.HeaderKeyId, xid.New().String())
+		ws, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			// pings are answered while reading
+			_, _, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	// the hostname is never resolved, 127.0.0.2 is not listened, and 192.0.2.0/24 is for documentation only
+	candidates, err := ParseCandidates([]string{"127.0.0.2", "127.0.0.1", "192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("parse failure: %v", err)
+	}
+	proxy := "ws://edge.invalid:" + port + "/proxy"
+	o, err := NewOptimizer(proxy, "12345", protocol.DefaultDialer(), candidates,
+		Options{MaxProbes: 4, Samples: 2, Timeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("new optimizer failure: %v", err)
+	}
+
+	o.probe()
+	best := o.Best()
+	if len(best) != 1 || !best[0].IP.Equal(net.ParseIP("127.0.0.1")) || best[0].Loss != 0 || best[0].RTT <= 0 {
+		t.Fatalf("unexpected best: %+v", best)
+	}
+
+	dialer := protocol.DefaultDialer()
+	dialer.WsDialer.NetDialContext = o.DialContext
+	_, err = dialer.Check(context.Background(), proxy, "12345")
+	if err != nil {
+		t.Fatalf("check over the edge failure: %v", err)
+	}
+	mutex.Lock()
+	for _, h := range hosts {
+		if h != "edge.invalid:"+port {
+			t.Errorf("unexpected host: %s", h)
+		}
+	}
+	mutex.Unlock()
+
+	// the best ones are kept if none is reachable
+	server.Close()
+	o.probe()
+	if len(o.Best()) != 1 {
+		t.Fatalf("best edges lost: %+v", o.Best())
+	}
+
+	// a failed edge is dropped, and the endpoint is dialed as usual
+	_, err = o.DialContext(context.Background(), "tcp", "edge.invalid:"+port)
+	if err == nil {
+		t.Fatalf("unexpected success of a closed server")
+	}
+	if len(o.Best()) != 0 {
+		t.Fatalf("failed edges kept: %+v", o.Best())
+	}
+
+	// an unreachable edge does not use up the time of dialing
+	o.mutex.Lock()
+	o.best = []Result{{IP: net.ParseIP("192.0.2.1"), Handshake: 50 * time.Millisecond}}
+	o.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	o.DialContext(ctx, "tcp", "edge.invalid:"+port)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dialing took %v", elapsed)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"net"
 	"net/http"
 	"sync"
 	"testing"
@@ -14,8 +15,8 @@ func TestFailAuth(t *testing.T) {
 	errCh := make(chan error)
 	go func() {
 		h := protocol.DefaultHandler()
-		h.Authenticator = func(remoteIp, auth string) bool {
-			return auth == "12345"
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
 		}
 		h.LogLevel = logger.LogLevelDebug
 
@@ -57,3 +58,70 @@ func TestFailAuth(t *testing.T) {
 		t.Log("ok")
 	}
 }
+
+func TestFailTarget(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.TargetFilter = func(user, host string, ip net.IP, port int) bool {
+			return !ip.IsLoopback()
+		}
+		h.LogLevel = logger.LogLevelDebug
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10083", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	time.Sleep(time.Second)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		dialer := protocol.DefaultDialer()
+		dialer.LogLevel = logger.LogLevelDebug
+		_, err := dialer.Dial("ws://127.0.0.1:10083/proxy", "", "tcp", "localhost:10083")
+		if err != nil {
+			t.Logf("err %v", err)
+		} else {
+			errCh <- errors.New("no error occurred")
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		dialer := protocol.DefaultDialer()
+		dialer.LogLevel = logger.LogLevelDebug
+		idleConn, err := dialer.DialIdle("ws://127.0.0.1:10083/proxy", "", nil)
+		if err != nil {
+			t.Log("client connect idle failure", err)
+			errCh <- err
+			return
+		}
+		_, err = idleConn.Dial("tcp", "127.0.0.1:10083")
+		if err != nil {
+			t.Logf("err %v", err)
+		} else {
+			errCh <- errors.New("no error occurred")
+		}
+	}()
+
+	doneCh := make(chan int)
+	go func() {
+		wg.Wait()
+		doneCh <- 1
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("failure: %v", err)
+	case <-doneCh:
+		t.Log("ok")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestFallback(t *testing.T) {
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "fallback "+r.URL.Path)
+	})
+
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.Fallback = fallback
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		mux.Handle("/", fallback)
+		err := http.ListenAndServe("127.0.0.1:10188", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		for _, path := range []string{"/proxy", "/index.html"} {
+			resp, err := http.Get("http://127.0.0.1:10188" + path)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "fallback "+path {
+				t.Errorf("unexpected response of %s: %d %s", path, resp.StatusCode, body)
+			}
+		}
+
+		dialer := protocol.DefaultDialer()
+		_, err := dialer.Dial("ws://127.0.0.1:10188/proxy", "wrong", "tcp", "127.0.0.1:10198")
+		if err == nil {
+			t.Errorf("unexpected success with a wrong key")
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
@@ -4,5 +4,19 @@ go 1.17
 
 require (
 	github.com/gorilla/websocket v1.4.2
+	github.com/prometheus/client_golang v1.12.2
 	github.com/rs/xid v1.3.0
+	golang.org/x/crypto v0.9.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
 )
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestPongTimeout(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		// a server which never reads, so that pings are not answered
+		upgrader := &websocket.Upgrader{}
+		err := http.ListenAndServe("127.0.0.1:10078", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := make(http.Header)
+			header.Set(protocol.HeaderKeyId, xid.New().String())
+			ws, err := upgrader.Upgrade(w, r, header)
+			if err != nil {
+				return
+			}
+			time.Sleep(5 * time.Second)
+			ws.Close()
+		}))
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		dialer.Heartbeat = protocol.Heartbeat{PingInterval: 100 * time.Millisecond}
+		dialer.MaxPongMisses = 2
+		conn, err := dialer.Dial("ws://127.0.0.1:10078/proxy", "12345", "tcp", "127.0.0.1:1")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		if err == nil {
+			t.Errorf("read from a dead conn succeeded")
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("dead conn detected after %v", d)
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10079", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10190")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	echo := func(conn protocol.TCPConn) error {
+		defer conn.Close()
+		time.Sleep(300 * time.Millisecond)
+		_, err := conn.Write([]byte("333"))
+		if err != nil {
+			return err
+		}
+		conn.CloseWrite()
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, []byte("333")) {
+			t.Errorf("unexpected data: %q", data)
+		}
+		if conn.(protocol.RTTConn).RTT() <= 0 {
+			t.Errorf("rtt not measured")
+		}
+		return nil
+	}
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		dialer.Heartbeat = protocol.Heartbeat{
+			PingInterval:      100 * time.Millisecond,
+			Jitter:            20 * time.Millisecond,
+			KeepaliveInterval: 30 * time.Millisecond,
+		}
+
+		conn, err := dialer.Dial("ws://127.0.0.1:10079/proxy", "12345", "tcp", "127.0.0.1:10190")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		err = echo(conn)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		idleConn, err := dialer.DialIdle("ws://127.0.0.1:10079/proxy", "12345", nil)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		time.Sleep(300 * time.Millisecond)
+		if idleConn.RTT() <= 0 {
+			t.Errorf("rtt of the idle conn not measured")
+		}
+		conn, err = idleConn.Dial("tcp", "127.0.0.1:10190")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		err = echo(conn)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		s, err := dialer.DialMux("ws://127.0.0.1:10079/proxy", "12345")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer s.Close()
+		time.Sleep(300 * time.Millisecond)
+		conn, err = s.Dial("tcp", "127.0.0.1:10190")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("333"))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		conn.CloseWrite()
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if !bytes.Equal(data, []byte("333")) {
+			t.Errorf("unexpected data over mux: %q", data)
+		}
+		if s.RTT() <= 0 {
+			t.Errorf("rtt of the mux session not measured")
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestPongHalfClose(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10173", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	received := make(chan []byte, 1)
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10196")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		c, err := l.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer c.Close()
+		// the target closes its write first, and keeps reading
+		c.Write([]byte("333"))
+		c.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(c)
+		received <- data
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		dialer.Heartbeat = protocol.Heartbeat{PingInterval: 100 * time.Millisecond}
+		dialer.MaxPongMisses = 2
+		conn, err := dialer.Dial("ws://127.0.0.1:10173/proxy", "12345", "tcp", "127.0.0.1:10196")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		data, err := io.ReadAll(conn)
+		if err != nil || string(data) != "333" {
+			t.Errorf("unexpected read: %q %v", data, err)
+		}
+
+		// nothing is read after the read EOF, pongs are still handled
+		time.Sleep(time.Second)
+		_, err = conn.Write([]byte("444"))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		conn.CloseWrite()
+		select {
+		case data := <-received:
+			if string(data) != "444" {
+				t.Errorf("unexpected data of the target: %q", data)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("target received nothing")
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestLimits(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "alice", auth == "12345"
+		}
+		h.Limits = protocol.NewLimits()
+		h.Limits.SetConfig(protocol.LimitConfig{MaxTunnelsPerUser: 1, MaxIdlePerIp: 1})
+		h.IdleRequestTimeout = time.Second
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10073", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10074")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		conn, err := dialer.Dial("ws://127.0.0.1:10073/proxy", "12345", "tcp", "127.0.0.1:10074")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		_, err = dialer.Dial("ws://127.0.0.1:10073/proxy", "12345", "tcp", "127.0.0.1:10074")
+		if protocol.ErrorCode(err) != protocol.ErrorCodeLimitExceeded {
+			t.Errorf("unexpected error of the second tunnel: %v", err)
+		}
+		conn.Close()
+
+		idleConn, err := dialer.DialIdle("ws://127.0.0.1:10073/proxy", "12345", nil)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer idleConn.Close()
+		_, err = dialer.DialIdle("ws://127.0.0.1:10073/proxy", "12345", nil)
+		if protocol.ErrorCode(err) != protocol.ErrorCodeLimitExceeded {
+			t.Errorf("unexpected error of the second idle conn: %v", err)
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+		_, err = idleConn.Dial("tcp", "127.0.0.1:10074")
+		if !errors.Is(err, protocol.ErrUseAnotherIdleConn) {
+			t.Errorf("unexpected error after idle request timeout: %v", err)
+		}
+		idleConn, err = dialer.DialIdle("ws://127.0.0.1:10073/proxy", "12345", nil)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer idleConn.Close()
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestHandshakeLimit(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			time.Sleep(time.Second)
+			return "alice", auth == "12345"
+		}
+		h.Limits = protocol.NewLimits()
+		h.Limits.SetConfig(protocol.LimitConfig{MaxHandshakes: 1})
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10195", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		go func() {
+			idleConn, err := dialer.DialIdle("ws://127.0.0.1:10195/proxy", "12345", nil)
+			if err == nil {
+				idleConn.Close()
+			}
+		}()
+		time.Sleep(200 * time.Millisecond)
+
+		// not authorized yet, nothing tells it's rejected by limits
+		_, err := dialer.DialIdle("ws://127.0.0.1:10195/proxy", "12345", nil)
+		if err == nil {
+			errCh <- errors.New("unexpected success over max handshakes")
+			return
+		}
+		if protocol.ErrorCode(err) == protocol.ErrorCodeLimitExceeded {
+			t.Errorf("unexpected error over max handshakes: %v", err)
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
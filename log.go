@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+	"weisuo/serverhelper"
+)
+
+const (
+	logOutputStderr   = "stderr"
+	logOutputFile     = "file"
+	logOutputSyslog   = "syslog"
+	logOutputJournald = "journald"
+)
+
+const (
+	logPrivacyHash = "hash"
+	logPrivacyOmit = "omit"
+)
+
+const logAppName = "weisuo"
+
+// The log sink is opened once at startup and kept across reloads, all packages log to it
+var (
+	logWriter io.Writer = os.Stderr
+	logFile   *logger.RotatingFile
+	// logSink is the syslog or journald logger, which ignores log_format
+	logSink logger.Logger
+	// logPrivacyKey is the key to hash targets, it's random for each process
+	logPrivacyKey = make([]byte, 32)
+)
+
+type appLogger struct {
+	l     logger.Logger
+	level logger.LogLevel
+	// privacy and target are of log_privacy
+	privacy string
+	target  protocol.LogTargetFunc
+}
+
+var currentLogger atomic.Value // *appLogger
+
+func init() {
+	currentLogger.Store(&appLogger{l: &logger.DefaultLogger{}, level: logger.LogLevelInfo})
+	_, _ = rand.Read(logPrivacyKey)
+}
+
+func checkLogConfig(c *Config) error {
+	_, err := logger.NewLogger(c.LogFormat, io.Discard)
+	if err != nil {
+		return err
+	}
+	switch c.LogOutput {
+	case "", logOutputStderr, logOutputSyslog, logOutputJournald:
+	case logOutputFile:
+		if c.LogFile == "" {
+			return errors.New("log_file is required if log_output is file")
+		}
+	default:
+		return fmt.Errorf("invalid log_output: %s", c.LogOutput)
+	}
+	switch c.LogPrivacy {
+	case "", logPrivacyHash, logPrivacyOmit:
+	default:
+		return fmt.Errorf("invalid log_privacy: %s", c.LogPrivacy)
+	}
+	return nil
+}
+
+// openLogSink opens the sink of log_output, and routes the standard logger to it
+func openLogSink() error {
+	var err error
+	switch cfg.LogOutput {
+	case logOutputFile:
+		logFile, err = logger.OpenRotatingFile(cfg.LogFile, int64(cfg.LogFileMaxSize)*1024*1024,
+			time.Duration(cfg.LogFileMaxAge)*time.Hour, int(cfg.LogFileMaxBackups))
+		logWriter = logFile
+	case logOutputSyslog:
+		logSink, err = logger.NewSyslogLogger(cfg.LogAddress, logAppName)
+	case logOutputJournald:
+		logSink, err = logger.NewJournaldLogger(cfg.LogAddress, logAppName)
+	}
+	if err != nil {
+		return err
+	}
+	al, err := newAppLogger(&cfg)
+	if err != nil {
+		return err
+	}
+	setAppLogger(al)
+	// e.g. errors of http.Server and log.Fatalf
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// makeLogger makes a logger of log_format, writing to the sink
+func makeLogger(c *Config) (logger.Logger, error) {
+	if logSink != nil {
+		return logSink, nil
+	}
+	return logger.NewLogger(c.LogFormat, logWriter)
+}
+
+// newAppLogger makes the logger of c for the main package and serverhelper
+func newAppLogger(c *Config) (*appLogger, error) {
+	l, err := makeLogger(c)
+	if err != nil {
+		return nil, err
+	}
+	return &appLogger{
+		l:       l,
+		level:   logger.GetLevel(c.LogLevel),
+		privacy: c.LogPrivacy,
+		target:  makeLogTarget(c),
+	}, nil
+}
+
+func setAppLogger(al *appLogger) {
+	currentLogger.Store(al)
+	serverhelper.SetLogger(al.l, al.level)
+}
+
+// reopenLogFile reopens the log file on SIGUSR1, after it's moved by tools like logrotate
+func reopenLogFile() {
+	if logFile == nil {
+		return
+	}
+	err := logFile.Reopen()
+	if err != nil {
+		// the sink is closed, tell it the way that still works
+		fmt.Fprintf(os.Stderr, "reopen log file failure: %v\n", err)
+		return
+	}
+	logInfof("log file reopened")
+}
+
+// makeLogTarget returns the function to transform targets in logs by log_privacy
+func makeLogTarget(c *Config) protocol.LogTargetFunc {
+	switch c.LogPrivacy {
+	case logPrivacyHash:
+		return protocol.HashTargetHost(logPrivacyKey)
+	case logPrivacyOmit:
+		return protocol.OmitTargetHost
+	}
+	return nil
+}
+
+// logTarget returns the target as it's shown in logs
+func logTarget(target string) string {
+	f := currentLogger.Load().(*appLogger).target
+	if f == nil {
+		return target
+	}
+	return f(target)
+}
+
+// logError returns the error message for logs, in which the host of the target is hidden by log_privacy
+func logError(err error, target string) string {
+	return protocol.HideTargetHost(currentLogger.Load().(*appLogger).target, err.Error(), target)
+}
+
+// logRequestURI returns the uri of a proxy request for logs, only the host is logged if log_privacy is enabled
+func logRequestURI(r *http.Request) string {
+	if currentLogger.Load().(*appLogger).privacy == "" {
+		return r.RequestURI
+	}
+	return logTarget(r.Host)
+}
+
+// stdLogWriter writes lines of the standard logger to the sink as errors, regardless of log_level
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	al := currentLogger.Load().(*appLogger)
+	logger.Write(al.l, logger.LogLevelError, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+func logf(level logger.LogLevel, format string, a ...interface{}) {
+	al := currentLogger.Load().(*appLogger)
+	if al.level >= level {
+		logger.Write(al.l, level, fmt.Sprintf(format, a...))
+	}
+}
+
+func logDebugf(format string, a ...interface{}) {
+	logf(logger.LogLevelDebug, format, a...)
+}
+func logInfof(format string, a ...interface{}) {
+	logf(logger.LogLevelInfo, format, a...)
+}
+func logWarnf(format string, a ...interface{}) {
+	logf(logger.LogLevelWarn, format, a...)
+}
+func logErrorf(format string, a ...interface{}) {
+	logf(logger.LogLevelError, format, a...)
+}
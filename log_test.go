@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+)
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+func TestJSONLog(t *testing.T) {
+	var logBuf syncBuffer
+
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "alice", auth == "12345"
+		}
+		h.Logger = logger.NewJSONLogger(&logBuf)
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10089", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10099")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				t.Log("accept failure", err)
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		conn, err := dialer.Dial("ws://127.0.0.1:10089/proxy", "12345", "tcp", "127.0.0.1:10099")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		_, err = conn.Write([]byte("333"))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		_, err = io.ReadFull(conn, make([]byte, 3))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		conn.CloseWrite()
+		_, _ = io.Copy(io.Discard, conn)
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		for _, line := range bytes.Split(bytes.TrimSpace(logBuf.Bytes()), []byte("\n")) {
+			var entry map[string]interface{}
+			err := json.Unmarshal(line, &entry)
+			if err != nil {
+				errCh <- fmt.Errorf("invalid json: %v %s", err, line)
+				return
+			}
+			if entry["msg"] != "connection closed, sent 3 bytes, received 3 bytes" {
+				continue
+			}
+			for k, v := range map[string]interface{}{
+				"level":          "info",
+				"user":           "alice",
+				"real_ip":        "127.0.0.1",
+				"protocol":       "tcp",
+				"target":         "127.0.0.1:10099",
+				"bytes_sent":     float64(3),
+				"bytes_received": float64(3),
+			} {
+				if entry[k] != v {
+					errCh <- fmt.Errorf("unexpected %s: %s", k, line)
+					return
+				}
+			}
+			if entry["id"] == "" || entry["duration"] == nil {
+				errCh <- fmt.Errorf("missing id or duration: %s", line)
+				return
+			}
+			errCh <- nil
+			return
+		}
+		errCh <- fmt.Errorf("closing entry not found: %s", logBuf.Bytes())
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	var logBuf syncBuffer
+
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "alice", auth == "12345"
+		}
+		h.Logger = logger.NewJSONLogger(&logBuf)
+		h.LogLevel = logger.LogLevelDebug
+		h.LogTarget = protocol.OmitTargetHost
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10187", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		_, err := dialer.Dial("ws://127.0.0.1:10187/proxy", "wrong-secret", "tcp", "127.0.0.1:10197")
+		if err == nil {
+			errCh <- fmt.Errorf("unexpected success")
+			return
+		}
+		// nothing listens on the target
+		_, err = dialer.Dial("ws://127.0.0.1:10187/proxy", "12345", "tcp", "127.0.0.1:10197")
+		if err == nil {
+			errCh <- fmt.Errorf("unexpected success 2")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		logs := logBuf.Bytes()
+		for _, secret := range []string{"wrong-secret", "12345", "127.0.0.1:10197"} {
+			if bytes.Contains(logs, []byte(secret)) {
+				errCh <- fmt.Errorf("%s found in logs: %s", secret, logs)
+				return
+			}
+		}
+		for _, expected := range []string{"unauthorized", "[REDACTED]", "*:10197"} {
+			if !bytes.Contains(logs, []byte(expected)) {
+				errCh <- fmt.Errorf("%s not found in logs: %s", expected, logs)
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestCheckLogConfig(t *testing.T) {
+	cases := []struct {
+		c  Config
+		ok bool
+	}{
+		{Config{}, true},
+		{Config{LogFormat: "json", LogOutput: "stderr"}, true},
+		{Config{LogOutput: "file", LogFile: "weisuo.log"}, true},
+		{Config{LogOutput: "file"}, false},
+		{Config{LogOutput: "journald"}, true},
+		{Config{LogOutput: "kafka"}, false},
+		{Config{LogFormat: "xml"}, false},
+		{Config{LogPrivacy: "hash"}, true},
+		{Config{LogPrivacy: "encrypt"}, false},
+	}
+	for _, c := range cases {
+		err := checkLogConfig(&c.c)
+		if (err == nil) != c.ok {
+			t.Errorf("unexpected result of %+v: %v", c.c, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102T150405.000"
+
+// RotatingFile is a log file, which is rotated once it's larger than MaxSize or older than MaxAge.
+// Rotated files are renamed with the time as a suffix, at most MaxBackups of them are kept.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mutex    sync.Mutex
+	f        *os.File
+	size     int64
+	openTime time.Time
+}
+
+// OpenRotatingFile opens the file for appending, zero maxSize or maxAge means no rotation by it,
+// zero maxBackups means keeping all rotated files
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file, f.mutex must be held
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file failure: %v", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat log file failure: %v", err)
+	}
+	f.f = file
+	f.size = stat.Size()
+	f.openTime = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+	if f.shouldRotate(len(p)) {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) shouldRotate(n int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+int64(n) > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && time.Since(f.openTime) > f.maxAge
+}
+
+// rotate renames the current file and opens a new one, f.mutex must be held
+func (f *RotatingFile) rotate() error {
+	_ = f.f.Close()
+	f.f = nil
+
+	err := os.Rename(f.path, f.path+"."+time.Now().Format(rotatedTimeFormat))
+	if err != nil && !os.IsNotExist(err) {
+		// keep writing to the current file
+		_ = f.open()
+		return fmt.Errorf("rotate log file failure: %v", err)
+	}
+	f.removeBackups()
+	return f.open()
+}
+
+func (f *RotatingFile) removeBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		_, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(m, f.path+"."))
+		if err == nil {
+			backups = append(backups, m)
+		}
+	}
+	if len(backups) <= f.maxBackups {
+		return
+	}
+	// the time format sorts in order
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-f.maxBackups] {
+		_ = os.Remove(b)
+	}
+}
+
+// Reopen closes and opens the file again, which may have been moved by tools like logrotate
+func (f *RotatingFile) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.f != nil {
+		_ = f.f.Close()
+		f.f = nil
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
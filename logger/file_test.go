@@ -0,0 +1,84 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "weisuo.log")
+
+	f, err := OpenRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("open failure: %v", err)
+	}
+	defer f.Close()
+
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err = f.Write([]byte(s))
+		if err != nil {
+			t.Fatalf("write failure: %v", err)
+		}
+		// rotated files are named by milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil || string(content) != "dddddddd\n" {
+		t.Fatalf("unexpected content: %q %v", content, err)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("unexpected backups: %v", backups)
+	}
+	content, _ = os.ReadFile(backups[1])
+	if string(content) != "cccccccc\n" {
+		t.Fatalf("unexpected content of backup: %q", content)
+	}
+
+	// reopen after the file is moved away
+	err = os.Rename(path, filepath.Join(dir, "moved.log"))
+	if err != nil {
+		t.Fatalf("rename failure: %v", err)
+	}
+	err = f.Reopen()
+	if err != nil {
+		t.Fatalf("reopen failure: %v", err)
+	}
+	_, err = f.Write([]byte("eeee\n"))
+	if err != nil {
+		t.Fatalf("write failure: %v", err)
+	}
+	content, _ = os.ReadFile(path)
+	if string(content) != "eeee\n" {
+		t.Fatalf("unexpected content after reopen: %q", content)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weisuo.log")
+
+	f, err := OpenRotatingFile(path, 0, 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("open failure: %v", err)
+	}
+	defer f.Close()
+
+	_, _ = f.Write([]byte("old\n"))
+	time.Sleep(100 * time.Millisecond)
+	_, _ = f.Write([]byte("new\n"))
+
+	content, _ := os.ReadFile(path)
+	backups, _ := filepath.Glob(path + ".*")
+	if string(content) != "new\n" || len(backups) != 1 {
+		t.Fatalf("unexpected rotation: %q %v", content, backups)
+	}
+	content, _ = os.ReadFile(backups[0])
+	if !strings.HasPrefix(string(content), "old") {
+		t.Fatalf("unexpected content of backup: %q", content)
+	}
+}
@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultJournaldAddress = "/run/systemd/journal/socket"
+
+// JournaldLogger sends entries to journald with its native protocol, fields are sent as journal fields,
+// e.g. `real_ip` as `REAL_IP`
+type JournaldLogger struct {
+	address    string
+	identifier string
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func NewJournaldLogger(address, identifier string) (*JournaldLogger, error) {
+	if address == "" {
+		address = DefaultJournaldAddress
+	}
+	conn, err := net.Dial("unixgram", address)
+	if err != nil {
+		return nil, fmt.Errorf("connect journald failure: %v", err)
+	}
+	return &JournaldLogger{
+		address:    address,
+		identifier: identifier,
+		conn:       conn,
+	}, nil
+}
+
+func (l *JournaldLogger) Debug(message string) {
+	l.Log(LogLevelDebug, message)
+}
+func (l *JournaldLogger) Info(message string) {
+	l.Log(LogLevelInfo, message)
+}
+func (l *JournaldLogger) Warn(message string) {
+	l.Log(LogLevelWarn, message)
+}
+func (l *JournaldLogger) Error(message string) {
+	l.Log(LogLevelError, message)
+}
+
+func (l *JournaldLogger) Log(level LogLevel, message string, fields ...Field) {
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", message)
+	writeJournaldField(&buf, "PRIORITY", strconv.Itoa(syslogSeverity(level)))
+	writeJournaldField(&buf, "SYSLOG_IDENTIFIER", l.identifier)
+	for _, f := range fields {
+		name := journaldFieldName(f.Key)
+		if name != "" {
+			writeJournaldField(&buf, name, fieldString(f.Value))
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// entries larger than the max size of datagrams are dropped, they should not be that large
+	_, err := l.conn.Write(buf.Bytes())
+	if err != nil {
+		// reconnect once, journald may have been restarted
+		conn, err := net.Dial("unixgram", l.address)
+		if err == nil {
+			l.conn.Close()
+			l.conn = conn
+			_, _ = l.conn.Write(buf.Bytes())
+		}
+	}
+}
+
+func writeJournaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	// values with newlines are serialized with the length
+	buf.WriteString(name + "\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// journaldFieldName converts the key to uppercase letters, digits and underscores, not starting with an underscore
+func journaldFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return ""
+	}
+	return name
+}
+
+func (l *JournaldLogger) Close() error {
+	return l.conn.Close()
+}
@@ -0,0 +1,42 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournaldLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatalf("listen failure: %v", err)
+	}
+	defer conn.Close()
+
+	l, err := NewJournaldLogger(path, "weisuo")
+	if err != nil {
+		t.Fatalf("new logger failure: %v", err)
+	}
+	defer l.Close()
+
+	l.Log(LogLevelError, "line 1\nline 2", F("real_ip", "1.2.3.4"), F("duration", 1500*time.Millisecond), F("_bad-key", 1))
+
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read failure: %v", err)
+	}
+
+	var expect bytes.Buffer
+	expect.WriteString("MESSAGE\n")
+	_ = binary.Write(&expect, binary.LittleEndian, uint64(len("line 1\nline 2")))
+	expect.WriteString("line 1\nline 2\n")
+	expect.WriteString("PRIORITY=3\nSYSLOG_IDENTIFIER=weisuo\nREAL_IP=1.2.3.4\nDURATION=1.5\nBAD_KEY=1\n")
+	if !bytes.Equal(buf[:n], expect.Bytes()) {
+		t.Errorf("unexpected entry: %q", buf[:n])
+	}
+}
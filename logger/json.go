@@ -0,0 +1,71 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONLogger writes a JSON object per line, with keys `time`, `level`, `msg` and the fields
+type JSONLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+func (l *JSONLogger) Debug(message string) {
+	l.Log(LogLevelDebug, message)
+}
+func (l *JSONLogger) Info(message string) {
+	l.Log(LogLevelInfo, message)
+}
+func (l *JSONLogger) Warn(message string) {
+	l.Log(LogLevelWarn, message)
+}
+func (l *JSONLogger) Error(message string) {
+	l.Log(LogLevelError, message)
+}
+
+func (l *JSONLogger) Log(level LogLevel, message string, fields ...Field) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSONValue(&buf, time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, message)
+	for _, f := range fields {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, f.Key)
+		buf.WriteByte(':')
+		writeJSONValue(&buf, f.Value)
+	}
+	buf.WriteString("}\n")
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, _ = l.w.Write(buf.Bytes())
+}
+
+// writeJSONValue writes errors as strings and durations as seconds
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	switch value := v.(type) {
+	case error:
+		v = value.Error()
+	case time.Duration:
+		v = value.Seconds()
+	case fmt.Stringer:
+		v = value.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprintf("%v", v))
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,62 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONLogger(&buf)
+	l.Log(LogLevelWarn, "hello \"world\"",
+		F("id", "abc"),
+		F("bytes_sent", int64(3)),
+		F("duration", 1500*time.Millisecond),
+		F("error", errors.New("failure")),
+	)
+	l.Info("plain")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("unexpected lines: %s", buf.String())
+	}
+
+	var entry map[string]interface{}
+	err := json.Unmarshal(lines[0], &entry)
+	if err != nil {
+		t.Fatalf("invalid json: %v %s", err, lines[0])
+	}
+	expect := map[string]interface{}{
+		"level":      "warning",
+		"msg":        "hello \"world\"",
+		"id":         "abc",
+		"bytes_sent": float64(3),
+		"duration":   1.5,
+		"error":      "failure",
+	}
+	for k, v := range expect {
+		if entry[k] != v {
+			t.Errorf("unexpected %s: %v", k, entry[k])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Errorf("unexpected time: %v", entry["time"])
+	}
+
+	err = json.Unmarshal(lines[1], &entry)
+	if err != nil || entry["level"] != "info" || entry["msg"] != "plain" {
+		t.Errorf("unexpected entry: %s", lines[1])
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	for format, ok := range map[string]bool{"": true, "text": true, "json": true, "xml": false} {
+		_, err := NewLogger(format, &bytes.Buffer{})
+		if (err == nil) != ok {
+			t.Errorf("format %s: %v", format, err)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package logger
 
-import "log"
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
 
 type Logger interface {
 	Debug(message string)
@@ -9,6 +15,22 @@ type Logger interface {
 	Error(message string)
 }
 
+// Field is a key/value pair of a structured log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// StructuredLogger is a Logger which accepts fields, messages are logged with fields instead of text prefixes
+type StructuredLogger interface {
+	Logger
+	Log(level LogLevel, message string, fields ...Field)
+}
+
 type LogLevel uint
 
 const (
@@ -47,3 +69,60 @@ func GetLevel(level string) LogLevel {
 	}
 	return LogLevelInfo
 }
+
+func (l LogLevel) String() string {
+	switch {
+	case l >= LogLevelDebug:
+		return "debug"
+	case l >= LogLevelInfo:
+		return "info"
+	case l >= LogLevelWarn:
+		return "warning"
+	case l >= LogLevelError:
+		return "error"
+	}
+	return "no"
+}
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// NewLogger returns a logger writing to w in the format, which is `text` or `json`
+func NewLogger(format string, w io.Writer) (Logger, error) {
+	switch format {
+	case "", FormatText:
+		return NewTextLogger(w), nil
+	case FormatJSON:
+		return NewJSONLogger(w), nil
+	}
+	return nil, fmt.Errorf("invalid log format: %s", format)
+}
+
+// Write writes a message of the level to l
+func Write(l Logger, level LogLevel, message string) {
+	switch {
+	case level >= LogLevelDebug:
+		l.Debug(message)
+	case level >= LogLevelInfo:
+		l.Info(message)
+	case level >= LogLevelWarn:
+		l.Warn(message)
+	default:
+		l.Error(message)
+	}
+}
+
+// fieldString formats values of fields for text based sinks, durations are in seconds
+func fieldString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case error:
+		return value.Error()
+	case time.Duration:
+		return strconv.FormatFloat(value.Seconds(), 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
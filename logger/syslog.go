@@ -0,0 +1,154 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSyslogAddress = "/dev/log"
+
+	syslogFacilityDaemon = 3
+	// syslogSdId is the id of structured data, 32473 is the private enterprise number for documentation
+	syslogSdId = "weisuo@32473"
+)
+
+// SyslogLogger sends RFC 5424 messages to the syslog daemon over a unix socket, fields are sent as structured data
+type SyslogLogger struct {
+	address  string
+	appName  string
+	hostname string
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func NewSyslogLogger(address, appName string) (*SyslogLogger, error) {
+	if address == "" {
+		address = DefaultSyslogAddress
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	l := &SyslogLogger{
+		address:  address,
+		appName:  appName,
+		hostname: hostname,
+	}
+	err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// connect connects the syslog daemon, l.mutex must be held
+func (l *SyslogLogger) connect() error {
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		var conn net.Conn
+		conn, err = net.Dial(network, l.address)
+		if err == nil {
+			l.conn = conn
+			return nil
+		}
+	}
+	return fmt.Errorf("connect syslog failure: %v", err)
+}
+
+func (l *SyslogLogger) Debug(message string) {
+	l.Log(LogLevelDebug, message)
+}
+func (l *SyslogLogger) Info(message string) {
+	l.Log(LogLevelInfo, message)
+}
+func (l *SyslogLogger) Warn(message string) {
+	l.Log(LogLevelWarn, message)
+}
+func (l *SyslogLogger) Error(message string) {
+	l.Log(LogLevelError, message)
+}
+
+func (l *SyslogLogger) Log(level LogLevel, message string, fields ...Field) {
+	msg := l.format(level, time.Now(), message, fields)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conn != nil {
+		_, err := l.conn.Write(msg)
+		if err == nil {
+			return
+		}
+		l.conn.Close()
+		l.conn = nil
+	}
+	// reconnect once, the syslog daemon may have been restarted
+	if l.connect() == nil {
+		_, _ = l.conn.Write(msg)
+	}
+}
+
+func (l *SyslogLogger) format(level LogLevel, t time.Time, message string, fields []Field) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d - ",
+		syslogFacilityDaemon*8+syslogSeverity(level), t.Format(time.RFC3339Nano), l.hostname, l.appName, os.Getpid())
+	if len(fields) == 0 {
+		buf.WriteString("-")
+	} else {
+		buf.WriteString("[" + syslogSdId)
+		for _, f := range fields {
+			fmt.Fprintf(&buf, ` %s="%s"`, syslogParamName(f.Key), syslogParamValue(fieldString(f.Value)))
+		}
+		buf.WriteString("]")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(message)
+	// like log/syslog, so that it works on a stream socket too
+	if !strings.HasSuffix(message, "\n") {
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func syslogSeverity(level LogLevel) int {
+	switch {
+	case level >= LogLevelDebug:
+		return 7
+	case level >= LogLevelInfo:
+		return 6
+	case level >= LogLevelWarn:
+		return 4
+	}
+	return 3
+}
+
+// syslogParamName removes characters not allowed in SD-NAME
+func syslogParamName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+}
+
+func syslogParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+func (l *SyslogLogger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestSyslogLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatalf("listen failure: %v", err)
+	}
+	defer conn.Close()
+
+	l, err := NewSyslogLogger(path, "weisuo")
+	if err != nil {
+		t.Fatalf("new logger failure: %v", err)
+	}
+	defer l.Close()
+
+	read := func() string {
+		buf := make([]byte, 4096)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read failure: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	l.Log(LogLevelWarn, "closed", F("real_ip", "1.2.3.4"), F("error", errors.New(`bad "]`)))
+	expect := regexp.MustCompile(`^<28>1 \S+ \S+ weisuo \d+ - \[weisuo@32473 real_ip="1\.2\.3\.4" error="bad \\"\\]"\] closed\n$`)
+	if msg := read(); !expect.MatchString(msg) {
+		t.Errorf("unexpected message: %q", msg)
+	}
+
+	l.Info("plain")
+	expect = regexp.MustCompile(`^<30>1 \S+ \S+ weisuo \d+ - - plain\n$`)
+	if msg := read(); !expect.MatchString(msg) {
+		t.Errorf("unexpected message: %q", msg)
+	}
+}
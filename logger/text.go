@@ -0,0 +1,28 @@
+package logger
+
+import (
+	"io"
+	"log"
+)
+
+// TextLogger writes lines like DefaultLogger, to w instead of the standard logger
+type TextLogger struct {
+	l *log.Logger
+}
+
+func NewTextLogger(w io.Writer) *TextLogger {
+	return &TextLogger{l: log.New(w, "", log.LstdFlags)}
+}
+
+func (l *TextLogger) Debug(message string) {
+	l.l.Printf("DEBUG %s", message)
+}
+func (l *TextLogger) Info(message string) {
+	l.l.Printf("INFO %s", message)
+}
+func (l *TextLogger) Warn(message string) {
+	l.l.Printf("WARN %s", message)
+}
+func (l *TextLogger) Error(message string) {
+	l.l.Printf("ERR %s", message)
+}
@@ -2,84 +2,308 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"sync/atomic"
+	"weisuo/pool"
+	"weisuo/serverhelper"
 )
 
 var (
 	fConfig = flag.String("config", "config.json", "path of config file")
+	// cfg is the config loaded at startup, reloaded ones are passed to builders and kept in current
 	cfg     = Config{}
+	current atomic.Value // *Config
 )
 
+// currentConfig returns the config applied last
+func currentConfig() *Config {
+	if c, ok := current.Load().(*Config); ok {
+		return c
+	}
+	return &cfg
+}
+
 type Config struct {
-	Listen            string `json:"listen"`
-	Mode              string `json:"mode"`
-	Key               string `json:"key"`
-	Endpoint          string `json:"endpoint"`
-	Insecure          bool   `json:"insecure"`
-	TLSCert           string `json:"tls_cert"`
-	TLSKey            string `json:"tls_key"`
-	LogLevel          string `json:"log_level"`
-	ServerPreset      string `json:"server_preset"`
-	SpeedTestEndpoint string `json:"speedtest_endpoint"`
-	ClientPool        uint   `json:"client_pool"`
-	ClientResolver    string `json:"client_resolver"`
+	Listen                string `json:"listen"`
+	Mode                  string `json:"mode"`
+	Key                   string `json:"key"`
+	Endpoint              string `json:"endpoint"`
+	Insecure              bool   `json:"insecure"`
+	TLSCert               string `json:"tls_cert"`
+	TLSKey                string `json:"tls_key"`
+	LogLevel              string `json:"log_level"`
+	LogFormat             string `json:"log_format"`
+	LogOutput             string `json:"log_output"`
+	LogFile               string `json:"log_file"`
+	LogFileMaxSize        uint   `json:"log_file_max_size"`
+	LogFileMaxAge         uint   `json:"log_file_max_age"`
+	LogFileMaxBackups     uint   `json:"log_file_max_backups"`
+	LogAddress            string `json:"log_address"`
+	LogPrivacy            string `json:"log_privacy"`
+	ServerPreset          string `json:"server_preset"`
+	SpeedTestEndpoint     string `json:"speedtest_endpoint"`
+	FallbackDir           string `json:"fallback_dir"`
+	FallbackUpstream      string `json:"fallback_upstream"`
+	MetricsEndpoint       string `json:"metrics_endpoint"`
+	MetricsKey            string `json:"metrics_key"`
+	AdminListen           string `json:"admin_listen"`
+	AdminKey              string `json:"admin_key"`
+	DrainTimeout          uint   `json:"drain_timeout"`
+	EndpointPolicy        string `json:"endpoint_policy"`
+	EndpointCheckInterval uint   `json:"endpoint_check_interval"`
+	ClientPool            uint   `json:"client_pool"`
+	ClientPoolMax         uint   `json:"client_pool_max"`
+	ClientPoolMaxIdleAge  uint   `json:"client_pool_max_idle_age"`
+	ClientResolver        string `json:"client_resolver"`
+	UDPIdleTimeout        uint   `json:"udp_idle_timeout"`
+	ClientMux             bool   `json:"client_mux"`
+	ClientMaxPongMisses   uint   `json:"client_max_pong_misses"`
+	AuthScheme            string `json:"auth_scheme"`
+	AuthMaxSkew           uint   `json:"auth_max_skew"`
+	UsersFile             string `json:"users_file"`
+	BanMaxFailures        uint   `json:"ban_max_failures"`
+	BanWindow             uint   `json:"ban_window"`
+	BanDuration           uint   `json:"ban_duration"`
+	BanMaxDuration        uint   `json:"ban_max_duration"`
+	BanFile               string `json:"ban_file"`
+	UsageFile             string `json:"usage_file"`
+	MaxHandshakes         uint   `json:"max_handshakes"`
+	MaxTunnelsPerUser     uint   `json:"max_tunnels_per_user"`
+	MaxIdlePerUser        uint   `json:"max_idle_per_user"`
+	MaxIdlePerIp          uint   `json:"max_idle_per_ip"`
+	MaxTunnelsPerTarget   uint   `json:"max_tunnels_per_target"`
+	IdleRequestTimeout    uint   `json:"idle_request_timeout"`
+	TunnelIdleTimeout     uint   `json:"tunnel_idle_timeout"`
+	TunnelMaxLifetime     uint   `json:"tunnel_max_lifetime"`
+	Socks5Username        string `json:"socks5_username"`
+	Socks5Password        string `json:"socks5_password"`
+
+	TargetACL *serverhelper.ACLConfig   `json:"target_acl"`
+	Quota     *serverhelper.QuotaConfig `json:"quota"`
+	RateLimit *RateLimitConfig          `json:"rate_limit"`
+	Heartbeat *HeartbeatConfig          `json:"heartbeat"`
+	Endpoints []EndpointConfig          `json:"endpoints"`
+	Edge      *EdgeConfig               `json:"edge"`
 }
 
 const (
-	modeServer     = "server"
-	modeClientNat  = "client_nat"
-	modeClientHttp = "client_http"
+	modeServer       = "server"
+	modeClientNat    = "client_nat"
+	modeClientHttp   = "client_http"
+	modeClientSocks5 = "client_socks5"
+)
+
+const (
+	authSchemeStatic = "static"
+	authSchemeHmac   = "hmac"
+)
+
+const (
+	serverPresetCloudflare    = "cloudflare"
+	serverPresetAwsCloudfront = "aws_cloudfront"
 )
 
-func loadConfig() {
+func loadConfig(c *Config) error {
 	f, err := os.Open(*fConfig)
 	if err != nil {
-		log.Fatalf("open config file failure: %v", err)
+		return fmt.Errorf("open config file failure: %v", err)
 	}
 	defer f.Close()
 
-	err = json.NewDecoder(f).Decode(&cfg)
+	err = json.NewDecoder(f).Decode(c)
 	if err != nil {
-		log.Fatalf("parse config file failure: %v", err)
+		return fmt.Errorf("parse config file failure: %v", err)
 	}
+	return nil
 }
 
-func checkConfig() {
+func checkEndpoint(endpoint string, insecure bool) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpont: %v", err)
+	}
+	switch u.Scheme {
+	case "wss":
+	case "ws":
+		if !insecure {
+			return errors.New("do not use `ws` unless enable `insecure`")
+		}
+	default:
+		return errors.New("invalid endpont: protocol can be either `ws` or `wss`")
+	}
+	return nil
+}
+
+func checkConfig(c *Config) error {
 	isClient := false
-	switch cfg.Mode {
-	case modeClientNat, modeClientHttp:
+	switch c.Mode {
+	case modeClientNat, modeClientHttp, modeClientSocks5:
 		isClient = true
 	}
 
-	if isClient {
-		u, err := url.Parse(cfg.Endpoint)
+	if isClient && len(c.Endpoints) == 0 {
+		err := checkEndpoint(c.Endpoint, c.Insecure)
 		if err != nil {
-			log.Fatalf("invalid endpont: %v", err)
+			return err
+		}
+	}
+
+	if len(c.Endpoints) > 0 {
+		if !isClient {
+			return errors.New("endpoints is only supported by clients")
 		}
-		switch u.Scheme {
-		case "wss":
-		case "ws":
-			if !cfg.Insecure {
-				log.Fatalf("do not use `ws` unless enable `insecure`")
+		for _, e := range c.Endpoints {
+			err := checkEndpoint(e.Endpoint, c.Insecure)
+			if err != nil {
+				return err
+			}
+			if e.Heartbeat != nil && e.Heartbeat.PingJitter > 0 && e.Heartbeat.PingJitter >= e.Heartbeat.PingInterval {
+				return errors.New("ping_jitter of heartbeat must be less than ping_interval")
+			}
+			err = e.Edge.check()
+			if err != nil {
+				return err
 			}
+		}
+		switch c.EndpointPolicy {
+		case "", pool.PolicyRoundRobin, pool.PolicyLeastLatency, pool.PolicyFailover:
 		default:
-			log.Fatalf("invalid endpont: protocol can be either `ws` or `wss`")
+			return fmt.Errorf("unknown endpoint_policy: %s", c.EndpointPolicy)
+		}
+	}
+
+	if c.ClientResolver != "" {
+		_, err := parseClientResolver(c.ClientResolver)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Socks5Password != "" && c.Socks5Username == "" {
+		return errors.New("socks5_username is required if socks5_password is specified")
+	}
+
+	if c.UsersFile != "" {
+		if c.Mode != modeServer {
+			return errors.New("users_file is only supported by server")
+		}
+		if c.AuthScheme == authSchemeHmac {
+			return errors.New("users_file cannot work with the hmac auth_scheme")
+		}
+	} else if c.Key == "" {
+		return errors.New("empty key")
+	}
+
+	if c.AdminListen != "" {
+		if c.Mode != modeServer {
+			return errors.New("admin_listen is only supported by server")
+		}
+		if c.AdminKey == "" {
+			return errors.New("admin_key is required if admin_listen is specified")
 		}
 	}
 
-	if cfg.Key == "" {
-		log.Fatalf("empty key")
+	if c.RateLimit != nil && c.Mode != modeServer && (c.RateLimit.User != RateLimit{} || len(c.RateLimit.Users) > 0) {
+		return errors.New("user and users of rate_limit are only supported by server")
 	}
+
+	if c.Edge != nil {
+		if !isClient {
+			return errors.New("edge is only supported by clients")
+		}
+		if len(c.Endpoints) > 0 {
+			return errors.New("specify edge of each of endpoints instead")
+		}
+		err := c.Edge.check()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ClientPoolMax > 0 && c.ClientPoolMax < c.ClientPool {
+		return errors.New("client_pool_max should not be less than client_pool")
+	}
+
+	if c.Heartbeat != nil {
+		if !isClient {
+			return errors.New("heartbeat is only supported by clients")
+		}
+		if c.Heartbeat.PingJitter > 0 && c.Heartbeat.PingJitter >= c.Heartbeat.PingInterval {
+			return errors.New("ping_jitter of heartbeat must be less than ping_interval")
+		}
+	}
+
+	if c.UsageFile != "" && c.Mode != modeServer {
+		return errors.New("usage_file is only supported by server")
+	}
+	if c.Quota != nil && c.UsageFile == "" {
+		return errors.New("usage_file is required if quota is specified")
+	}
+
+	switch c.AuthScheme {
+	case "", authSchemeStatic, authSchemeHmac:
+	default:
+		return fmt.Errorf("invalid auth_scheme: %s", c.AuthScheme)
+	}
+
+	err := checkLogConfig(c)
+	if err != nil {
+		return err
+	}
+
+	if c.FallbackDir != "" || c.FallbackUpstream != "" {
+		if c.Mode != modeServer {
+			return errors.New("fallback_dir and fallback_upstream are only supported by server")
+		}
+		if c.FallbackDir != "" && c.FallbackUpstream != "" {
+			return errors.New("fallback_dir and fallback_upstream cannot be specified together")
+		}
+		_, err = makeFallback(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch c.ServerPreset {
+	case "", serverPresetCloudflare, serverPresetAwsCloudfront:
+	default:
+		return fmt.Errorf("unexpected server preset: %s", c.ServerPreset)
+	}
+
+	if c.TargetACL != nil {
+		_, err = serverhelper.NewACL(c.TargetACL)
+		if err != nil {
+			return fmt.Errorf("invalid target_acl: %v", err)
+		}
+	}
+	return nil
 }
 
 func main() {
 	flag.Parse()
 
-	loadConfig()
-	checkConfig()
+	err := loadConfig(&cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if flag.Arg(0) == "stats" {
+		runStats(flag.Args()[1:])
+		return
+	}
+	err = checkConfig(&cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	err = openLogSink()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	shaping.apply(cfg.RateLimit)
 
 	switch cfg.Mode {
 	case modeServer:
@@ -88,6 +312,8 @@ func main() {
 		runClientHttp()
 	case modeClientNat:
 		runClientNat()
+	case modeClientSocks5:
+		runClientSocks5()
 	default:
 		log.Fatalf("unexpected mode: %v", cfg.Mode)
 	}
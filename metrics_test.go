@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+)
+
+func TestMetrics(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.LogLevel = logger.LogLevelDebug
+		h.Metrics = protocol.NewMetrics()
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		mux.Handle("/metrics", h.Metrics)
+		err := http.ListenAndServe("127.0.0.1:10085", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10095")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				t.Log("accept failure", err)
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		dialer.LogLevel = logger.LogLevelDebug
+
+		_, err := dialer.Dial("ws://127.0.0.1:10085/proxy", "54321", "tcp", "127.0.0.1:10095")
+		if err == nil {
+			errCh <- errors.New("unauthorized dial succeeded")
+			return
+		}
+
+		conn, err := dialer.Dial("ws://127.0.0.1:10085/proxy", "12345", "tcp", "127.0.0.1:10095")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		_, err = conn.Write([]byte("333"))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		conn.CloseWrite()
+		_, err = io.Copy(io.Discard, conn)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		conn.Close()
+
+		// health checks close idle connections without requests, which are not failures
+		_, err = dialer.Check(context.Background(), "ws://127.0.0.1:10085/proxy", "12345")
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		resp, err := http.Get("http://127.0.0.1:10085/metrics")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		for _, line := range []string{
+			`weisuo_tunnels{state="active"} 0`,
+			`weisuo_handshake_failures_total{reason="auth"} 1`,
+			`weisuo_target_dial_duration_seconds_count 1`,
+			`weisuo_sent_bytes_total{user=""} 3`,
+			`weisuo_received_bytes_total{user=""} 3`,
+		} {
+			if !strings.Contains(string(body), line+"\n") {
+				errCh <- fmt.Errorf("metrics without %s:\n%s", line, body)
+				return
+			}
+		}
+		if strings.Contains(string(body), `reason="bad_request"`) {
+			errCh <- fmt.Errorf("health check counted as a failure:\n%s", body)
+			return
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestMetricsKey(t *testing.T) {
+	h := metricsHandler(protocol.NewMetrics(), "metrics")
+	for _, c := range []struct {
+		auth string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer 12345", http.StatusUnauthorized},
+		{"Bearer metrics", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatalf("unexpected status of %q: %d", c.auth, w.Code)
+		}
+	}
+}
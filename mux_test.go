@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+)
+
+func TestMux(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.LogLevel = logger.LogLevelInfo
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10082", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10092")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				t.Log("accept failure", err)
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				// echo until EOF, then half close
+				io.Copy(c, c)
+				c.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	dialer := protocol.DefaultDialer()
+	dialer.LogLevel = logger.LogLevelInfo
+	session, err := dialer.DialMux("ws://127.0.0.1:10082/proxy", "12345")
+	if err != nil {
+		t.Fatalf("client connect mux failure: %v", err)
+	}
+	defer session.Close()
+
+	// larger than the flow control window
+	payload := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := session.Dial("tcp", "127.0.0.1:10092")
+			if err != nil {
+				t.Log("client connect failure:", err)
+				errCh <- err
+				return
+			}
+			defer conn.Close()
+
+			go func() {
+				conn.Write(payload)
+				conn.CloseWrite()
+			}()
+
+			buf, err := io.ReadAll(conn)
+			if err != nil {
+				t.Log("client read err:", err)
+				errCh <- err
+				return
+			}
+			if !bytes.Equal(buf, payload) {
+				t.Log("client read data unexpected", len(buf))
+				errCh <- errors.New("client read data")
+				return
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := session.Dial("tcp", "127.0.0.1:1")
+		if err == nil {
+			errCh <- errors.New("no error occurred")
+			return
+		}
+		var streamErr *protocol.StreamError
+		if !errors.As(err, &streamErr) {
+			t.Log("unexpected err", err)
+			errCh <- err
+			return
+		}
+		t.Logf("err %v", err)
+	}()
+
+	doneCh := make(chan int)
+	go func() {
+		wg.Wait()
+		doneCh <- 1
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("failure: %v", err)
+	case <-doneCh:
+		t.Log("ok")
+	}
+
+	if n := session.NumStreams(); n != 0 {
+		t.Fatalf("unexpected streams: %d", n)
+	}
+}
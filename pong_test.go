@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestIdleConnEvicted(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.IdleRequestTimeout = 500 * time.Millisecond
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10077", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		evicted := make(chan *protocol.IdleConn, 1)
+		start := time.Now()
+		c, err := dialer.DialIdle("ws://127.0.0.1:10077/proxy", "12345", func(c *protocol.IdleConn) {
+			evicted <- c
+		})
+		if err != nil {
+			errCh <- err
+			return
+		}
+		select {
+		case cc := <-evicted:
+			if cc != c {
+				t.Errorf("unexpected idle conn evicted")
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("evicted after %v", d)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("idle conn closed by the server is not evicted")
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package pool
+
+import (
+	"math"
+	"math/rand"
+	"time"
+	"weisuo/protocol"
+)
+
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+	// rateWindow is the time constant of the request rate
+	rateWindow = 10 * time.Second
+	// defaultConnectTime is the estimate of making a connection before it's measured
+	defaultConnectTime = time.Second
+)
+
+// Options of idle connections of a pool
+type Options struct {
+	MinIdle int
+	MaxIdle int
+	// MaxIdleAge rotates idle connections, each one is closed at a random age between half of it and it.
+	// Zero means no rotation.
+	MaxIdleAge time.Duration
+}
+
+// Stats of idle connections of a pool
+type Stats struct {
+	// Hits counts requests served by idle connections, Misses counts requests finding no idle connections
+	Hits   int64
+	Misses int64
+	// Evictions counts idle connections closed by age, or found dead
+	Evictions int64
+	// Stale counts idle connections found dead by requests, which are retried on others
+	Stale           int64
+	ConnectFailures int64
+	Idle            int
+	Connecting      int
+}
+
+type idleConn struct {
+	conn *protocol.IdleConn
+	// expire is zero if it's never rotated
+	expire time.Time
+}
+
+// rateCounter is an exponentially weighted rate of events per second
+type rateCounter struct {
+	rate float64
+	last time.Time
+}
+
+func (r *rateCounter) get(now time.Time) float64 {
+	if r.last.IsZero() {
+		return 0
+	}
+	return r.rate * math.Exp(-now.Sub(r.last).Seconds()/rateWindow.Seconds())
+}
+
+func (r *rateCounter) add(now time.Time) {
+	r.rate = r.get(now) + 1/rateWindow.Seconds()
+	r.last = now
+}
+
+// Stats returns stats of idle connections, which are summed up over endpoints of a balanced pool
+func (p *Pool) Stats() Stats {
+	if p.balance != nil {
+		var s Stats
+		for _, m := range p.balance.members {
+			ms := m.pool.Stats()
+			s.Hits += ms.Hits
+			s.Misses += ms.Misses
+			s.Evictions += ms.Evictions
+			s.Stale += ms.Stale
+			s.ConnectFailures += ms.ConnectFailures
+			s.Idle += ms.Idle
+			s.Connecting += ms.Connecting
+		}
+		return s
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	s := p.stats
+	s.Idle = len(p.idle)
+	s.Connecting = p.connecting
+	return s
+}
+
+// signal wakes run up to maintain idle connections
+func (p *Pool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run maintains idle connections on requests, results of connecting, and expiry, until the pool is closed
+func (p *Pool) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.wake:
+		case <-timer.C:
+		}
+
+		wait, ok := p.maintain()
+		if !ok {
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+	}
+}
+
+// maintain evicts expired idle connections and starts making new ones,
+// returns the time to wait for the next expiry or retry, or false if the pool is closed
+func (p *Pool) maintain() (time.Duration, bool) {
+	now := time.Now()
+	var expired []*protocol.IdleConn
+	var next time.Time
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return 0, false
+	}
+	idle := make([]*idleConn, 0, len(p.idle))
+	for _, c := range p.idle {
+		if !c.expire.IsZero() && !now.Before(c.expire) {
+			expired = append(expired, c.conn)
+			continue
+		}
+		idle = append(idle, c)
+		if !c.expire.IsZero() && (next.IsZero() || c.expire.Before(next)) {
+			next = c.expire
+		}
+	}
+	p.idle = idle
+	p.stats.Evictions += int64(len(expired))
+
+	need := p.target(now) - len(p.idle) - p.connecting
+	switch {
+	case need <= 0:
+		need = 0
+	case now.Before(p.nextRetry):
+		if next.IsZero() || p.nextRetry.Before(next) {
+			next = p.nextRetry
+		}
+		need = 0
+	case p.failures > 0:
+		// one at a time until the server is back
+		if p.connecting > 0 {
+			need = 0
+		} else {
+			need = 1
+		}
+	}
+	p.connecting += need
+	p.mutex.Unlock()
+
+	for _, c := range expired {
+		p.logDebugf("rotate %s", c.Id())
+		c.Close()
+	}
+	for i := 0; i < need; i++ {
+		go p.connect()
+	}
+	if next.IsZero() {
+		return 0, true
+	}
+	return time.Until(next), true
+}
+
+// target returns the number of idle connections to keep, which covers requests expected in the time of
+// making connections besides MinIdle. p.mutex must be held.
+func (p *Pool) target(now time.Time) int {
+	horizon := 2 * p.connectTime
+	if horizon < defaultConnectTime {
+		horizon = defaultConnectTime
+	}
+	n := p.opts.MinIdle + int(math.Round(p.rate.get(now)*horizon.Seconds()))
+	if n > p.opts.MaxIdle {
+		n = p.opts.MaxIdle
+	}
+	return n
+}
+
+func (p *Pool) connect() {
+	start := time.Now()
+	c, err := p.dialer.DialIdle(p.proxy, p.auth, p.evict)
+	d := time.Since(start)
+
+	p.mutex.Lock()
+	p.connecting--
+	if err != nil {
+		p.failures++
+		p.stats.ConnectFailures++
+		backoff := p.backoff()
+		p.nextRetry = time.Now().Add(backoff)
+		p.mutex.Unlock()
+		p.logErrorf("connect failure: %v, retry in %v", err, backoff.Round(time.Millisecond))
+		p.signal()
+		return
+	}
+	p.failures = 0
+	if p.connectTime == 0 {
+		p.connectTime = d
+	} else {
+		p.connectTime = (p.connectTime*7 + d) / 8
+	}
+	if p.closed {
+		p.mutex.Unlock()
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, &idleConn{conn: c, expire: p.expire(time.Now())})
+	p.mutex.Unlock()
+
+	p.logInfof("added %s", c.Id())
+	p.signal()
+}
+
+// evict removes the idle connection found dead
+func (p *Pool) evict(c *protocol.IdleConn) {
+	p.mutex.Lock()
+	for i, e := range p.idle {
+		if e.conn == c {
+			p.idle = append(p.idle[:i:i], p.idle[i+1:]...)
+			p.stats.Evictions++
+			p.mutex.Unlock()
+
+			p.logErrorf("remove %s", c.Id())
+			p.signal()
+			return
+		}
+	}
+	p.mutex.Unlock()
+}
+
+// backoff returns the delay of retrying after failures in a row, which is doubled each time, with jitter.
+// p.mutex must be held.
+func (p *Pool) backoff() time.Duration {
+	d := maxBackoff
+	if p.failures < 16 {
+		d = minBackoff << (p.failures - 1)
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// expire returns the time to rotate an idle connection made at now
+func (p *Pool) expire(now time.Time) time.Time {
+	if p.opts.MaxIdleAge <= 0 {
+		return time.Time{}
+	}
+	half := p.opts.MaxIdleAge / 2
+	return now.Add(half + time.Duration(rand.Int63n(int64(half)+1)))
+}
@@ -0,0 +1,269 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+	"weisuo/protocol"
+)
+
+// Policies of selecting endpoints of a balanced pool
+const (
+	// PolicyRoundRobin spreads requests over endpoints by their weights
+	PolicyRoundRobin = "round_robin"
+	// PolicyLeastLatency prefers the endpoint with the least ping RTT
+	PolicyLeastLatency = "least_latency"
+	// PolicyFailover prefers endpoints in the order of the list
+	PolicyFailover = "failover"
+
+	defaultCheckInterval = 30 * time.Second
+	defaultCheckTimeout  = 10 * time.Second
+)
+
+// Endpoint is a server of a balanced pool
+type Endpoint struct {
+	Proxy string
+	Auth  string
+	// Weight is the share of requests by round-robin, 1 if zero
+	Weight int
+	Dialer *protocol.Dialer
+}
+
+// BalanceOptions of a balanced pool
+type BalanceOptions struct {
+	Policy string
+	// CheckInterval and CheckTimeout of health checks, which are a handshake and a ping
+	CheckInterval time.Duration
+	CheckTimeout  time.Duration
+	// Mux makes a mux pool for each endpoint, otherwise Idle is used
+	Mux  bool
+	Idle Options
+}
+
+// EndpointStatus is the health of an endpoint
+type EndpointStatus struct {
+	Proxy   string
+	Healthy bool
+	// RTT of the last health check
+	RTT time.Duration
+}
+
+type balance struct {
+	opts    BalanceOptions
+	members []*member
+	stop    chan struct{}
+}
+
+type member struct {
+	Endpoint
+	pool *Pool
+
+	// guarded by the mutex of the balanced pool
+	healthy bool
+	rtt     time.Duration
+	// current is the state of smooth weighted round-robin
+	current int
+}
+
+// MakeBalancedPool makes a pool, which routes requests to pools of endpoints by the policy, and around endpoints down
+func MakeBalancedPool(endpoints []Endpoint, opts BalanceOptions) *Pool {
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = defaultCheckInterval
+	}
+	if opts.CheckTimeout <= 0 {
+		opts.CheckTimeout = defaultCheckTimeout
+	}
+	b := &balance{
+		opts: opts,
+		stop: make(chan struct{}),
+	}
+	for _, e := range endpoints {
+		if e.Weight <= 0 {
+			e.Weight = 1
+		}
+		m := &member{Endpoint: e, healthy: true}
+		if opts.Mux {
+			m.pool = MakeMuxPool(e.Proxy, e.Auth, e.Dialer)
+		} else {
+			m.pool = MakeAdaptivePool(e.Proxy, e.Auth, opts.Idle, e.Dialer)
+		}
+		b.members = append(b.members, m)
+	}
+	p := &Pool{
+		// for logs
+		dialer:  endpoints[0].Dialer,
+		wake:    make(chan struct{}, 1),
+		balance: b,
+	}
+	go p.checkLoop()
+	return p
+}
+
+// Endpoints returns the health of endpoints of a balanced pool
+func (p *Pool) Endpoints() []EndpointStatus {
+	if p.balance == nil {
+		return nil
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var ret []EndpointStatus
+	for _, m := range p.balance.members {
+		ret = append(ret, EndpointStatus{Proxy: m.Proxy, Healthy: m.healthy, RTT: m.rtt})
+	}
+	return ret
+}
+
+func (p *Pool) closeBalance(drain bool) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	p.mutex.Unlock()
+
+	close(p.balance.stop)
+	for _, m := range p.balance.members {
+		if drain {
+			m.pool.Drain()
+		} else {
+			m.pool.Close()
+		}
+	}
+}
+
+func (p *Pool) checkLoop() {
+	for {
+		p.checkAll()
+		select {
+		case <-p.balance.stop:
+			return
+		case <-time.After(p.balance.opts.CheckInterval):
+		}
+	}
+}
+
+// checkAll checks endpoints concurrently
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, m := range p.balance.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), p.balance.opts.CheckTimeout)
+			defer cancel()
+			rtt, err := m.Dialer.Check(ctx, m.Proxy, m.Auth)
+			if err != nil {
+				p.markDown(m, err)
+				return
+			}
+			p.markUp(m, rtt)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) markDown(m *member, err error) {
+	p.mutex.Lock()
+	healthy := m.healthy
+	m.healthy = false
+	p.mutex.Unlock()
+	if healthy {
+		p.logWarnf("endpoint %s down: %v", m.Proxy, err)
+	}
+}
+
+func (p *Pool) markUp(m *member, rtt time.Duration) {
+	p.mutex.Lock()
+	healthy := m.healthy
+	m.healthy = true
+	m.rtt = rtt
+	p.mutex.Unlock()
+	if !healthy {
+		p.logInfof("endpoint %s up, rtt %v", m.Proxy, rtt)
+	}
+}
+
+// order returns members to try, healthy ones first by the policy, and then ones down as the last resort.
+// p.mutex must be held.
+func (b *balance) order() []*member {
+	var healthy, down []*member
+	for _, m := range b.members {
+		if m.healthy {
+			healthy = append(healthy, m)
+		} else {
+			down = append(down, m)
+		}
+	}
+
+	switch b.opts.Policy {
+	case PolicyFailover:
+	case PolicyLeastLatency:
+		// unknown RTT goes last
+		sort.SliceStable(healthy, func(i, j int) bool {
+			ri, rj := healthy[i].rtt, healthy[j].rtt
+			return rj == 0 && ri != 0 || ri != 0 && ri < rj
+		})
+	default:
+		if len(healthy) > 1 {
+			first := nextWeighted(healthy)
+			for i, m := range healthy {
+				if m == first {
+					copy(healthy[1:i+1], healthy[:i])
+					healthy[0] = first
+					break
+				}
+			}
+		}
+	}
+	return append(healthy, down...)
+}
+
+// nextWeighted selects a member by smooth weighted round-robin
+func nextWeighted(members []*member) *member {
+	var best *member
+	total := 0
+	for _, m := range members {
+		m.current += m.Weight
+		total += m.Weight
+		if best == nil || m.current > best.current {
+			best = m
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// route dials with pools of members in order, until one succeeds or fails not because of the endpoint
+func (p *Pool) route(ctx context.Context, dial func(*Pool) error) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return errors.New("pool closed")
+	}
+	members := p.balance.order()
+	p.mutex.Unlock()
+
+	var err error
+	for _, m := range members {
+		err = dial(m.pool)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		var dialErr *protocol.DialError
+		var streamErr *protocol.StreamError
+		switch {
+		case errors.As(err, &dialErr) || errors.As(err, &streamErr):
+			// reported by the server, other endpoints would fail too, unless it's overloaded
+			if protocol.ErrorCode(err) != protocol.ErrorCodeLimitExceeded {
+				return err
+			}
+		default:
+			p.markDown(m, err)
+		}
+		p.logWarnf("dial over %s failure: %v, try another endpoint", m.Proxy, err)
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package pool
+
+import (
+	"fmt"
+	"weisuo/logger"
+)
+
+// logf logs with the logger of the dialer
+func (p *Pool) logf(level logger.LogLevel, format string, a ...interface{}) {
+	if p.dialer.Logger != nil && p.dialer.LogLevel >= level {
+		logger.Write(p.dialer.Logger, level, "POOL "+fmt.Sprintf(format, a...))
+	}
+}
+
+func (p *Pool) logDebugf(format string, a ...interface{}) {
+	p.logf(logger.LogLevelDebug, format, a...)
+}
+func (p *Pool) logInfof(format string, a ...interface{}) {
+	p.logf(logger.LogLevelInfo, format, a...)
+}
+func (p *Pool) logWarnf(format string, a ...interface{}) {
+	p.logf(logger.LogLevelWarn, format, a...)
+}
+func (p *Pool) logErrorf(format string, a ...interface{}) {
+	p.logf(logger.LogLevelError, format, a...)
+}
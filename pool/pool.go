@@ -1,91 +1,132 @@
 package pool
 
 import (
+	"context"
 	"errors"
-	"log"
 	"sync"
 	"time"
 	"weisuo/protocol"
 )
 
+// maxIdleAttempts is the number of stale idle connections tried by a request before making a new connection
+const maxIdleAttempts = 3
+
 type Pool struct {
 	proxy  string
 	auth   string
 	dialer *protocol.Dialer
-	conn   []*protocol.IdleConn
+	opts   Options
 	mutex  sync.RWMutex
 	closed bool
+
+	// idle connections, the oldest first
+	idle       []*idleConn
+	connecting int
+	// wake triggers maintaining idle connections
+	wake        chan struct{}
+	rate        rateCounter
+	connectTime time.Duration
+	failures    int
+	nextRetry   time.Time
+	stats       Stats
+
+	mux        bool
+	muxSession *protocol.MuxSession
+	muxMutex   sync.Mutex
+
+	// balance routes requests to pools of endpoints, if it's a balanced pool
+	balance *balance
 }
 
+// MakePool makes a pool, which keeps size idle connections
 func MakePool(proxy, auth string, size uint, dialer *protocol.Dialer) *Pool {
+	return MakeAdaptivePool(proxy, auth, Options{MinIdle: int(size), MaxIdle: int(size)}, dialer)
+}
+
+// MakeAdaptivePool makes a pool, which keeps idle connections between MinIdle and MaxIdle of opts by the request rate
+func MakeAdaptivePool(proxy, auth string, opts Options, dialer *protocol.Dialer) *Pool {
+	if opts.MaxIdle < opts.MinIdle {
+		opts.MaxIdle = opts.MinIdle
+	}
 	p := &Pool{
 		proxy:  proxy,
 		auth:   auth,
 		dialer: dialer,
-		conn:   make([]*protocol.IdleConn, size),
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
 	}
-	for i := 0; i < int(size); i++ {
-		go p.worker(i)
+	if opts.MaxIdle > 0 {
+		go p.run()
 	}
-
 	return p
 }
 
-func (p *Pool) worker(i int) {
-	for {
-		time.Sleep(500 * time.Millisecond)
-
-		p.mutex.RLock()
-		if p.closed {
-			p.mutex.RUnlock()
-			break
-		}
-		need := p.conn[i] == nil
-		p.mutex.RUnlock()
+// MakeMuxPool makes a pool, which carries all tcp streams over a single long-lived WebSocket connection
+func MakeMuxPool(proxy, auth string, dialer *protocol.Dialer) *Pool {
+	return &Pool{
+		proxy:  proxy,
+		auth:   auth,
+		dialer: dialer,
+		wake:   make(chan struct{}, 1),
+		mux:    true,
+	}
+}
 
-		if !need {
-			continue
-		}
+func (p *Pool) Close() {
+	if p.balance != nil {
+		p.closeBalance(false)
+		return
+	}
+	p.closeIdle()
 
-		c, err := p.connectIdle(func(cc *protocol.IdleConn) {
-			p.mutex.Lock()
-			defer p.mutex.Unlock()
+	// getMuxSession locks muxMutex before mutex
+	p.muxMutex.Lock()
+	defer p.muxMutex.Unlock()
+	if p.muxSession != nil {
+		p.muxSession.Close()
+		p.muxSession = nil
+	}
+}
 
-			if p.conn[i] == cc {
-				log.Printf("ERR POOL remove %s", cc.Id())
-				p.conn[i] = nil
-			}
-		})
-		if err != nil {
-			log.Printf("ERR POOL connect failure: %v", err)
-			time.Sleep(500 * time.Millisecond)
-			continue
-		}
+// Drain stops making connections and closes idle ones, the mux session is closed once its streams are finished
+func (p *Pool) Drain() {
+	if p.balance != nil {
+		p.closeBalance(true)
+		return
+	}
+	p.closeIdle()
 
-		p.mutex.Lock()
-		p.conn[i] = c
-		p.mutex.Unlock()
-		log.Printf("INFO POOL added %s", c.Id())
+	p.muxMutex.Lock()
+	defer p.muxMutex.Unlock()
+	if p.muxSession != nil {
+		p.muxSession.Drain()
 	}
 }
 
-func (p *Pool) Close() {
+// closeIdle stops making connections and closes idle ones
+func (p *Pool) closeIdle() {
 	p.mutex.Lock()
-	defer p.mutex.Unlock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
 	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	stats := p.stats
+	p.mutex.Unlock()
 
-	for i, c := range p.conn {
-		if c != nil {
-			c.Close()
-			p.conn[i] = nil
-		}
+	p.signal()
+	for _, c := range idle {
+		c.conn.Close()
+	}
+	if !p.mux {
+		p.logInfof("closed, %d hits, %d misses, %d evictions, %d stale, %d connect failures",
+			stats.Hits, stats.Misses, stats.Evictions, stats.Stale, stats.ConnectFailures)
 	}
 }
 
-func (p *Pool) connectIdle(errCb func(*protocol.IdleConn)) (*protocol.IdleConn, error) {
-	return p.dialer.DialIdle(p.proxy, p.auth, errCb)
-}
-
+// Pick takes the oldest idle connection, or returns nil if there are none
 func (p *Pool) Pick() (*protocol.IdleConn, error) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
@@ -94,32 +135,169 @@ func (p *Pool) Pick() (*protocol.IdleConn, error) {
 		return nil, errors.New("pool closed")
 	}
 
-	var ret *protocol.IdleConn
-	for i, c := range p.conn {
-		if c != nil {
-			ret = c
-			p.conn[i] = nil
-			break
+	p.rate.add(time.Now())
+	p.signal()
+	if len(p.idle) == 0 {
+		p.stats.Misses++
+		return nil, nil
+	}
+	p.stats.Hits++
+	c := p.idle[0]
+	p.idle = p.idle[1:]
+	return c.conn, nil
+}
+
+// RTT returns the average round-trip time measured by pings of idle connections and the mux session,
+// or zero if not measured yet
+func (p *Pool) RTT() time.Duration {
+	var sum time.Duration
+	n := 0
+	if p.balance != nil {
+		for _, m := range p.balance.members {
+			if rtt := m.pool.RTT(); rtt > 0 {
+				sum += rtt
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
 		}
+		return sum / time.Duration(n)
 	}
 
-	return ret, nil
-}
+	p.mutex.RLock()
+	for _, c := range p.idle {
+		if rtt := c.conn.RTT(); rtt > 0 {
+			sum += rtt
+			n++
+		}
+	}
+	p.mutex.RUnlock()
+
+	p.muxMutex.Lock()
+	if p.muxSession != nil {
+		if rtt := p.muxSession.RTT(); rtt > 0 {
+			sum += rtt
+			n++
+		}
+	}
+	p.muxMutex.Unlock()
 
-func (p *Pool) connectImmediately(proto, target string) (protocol.TCPConn, error) {
-	return p.dialer.Dial(p.proxy, p.auth, proto, target)
+	if n == 0 {
+		return 0
+	}
+	return sum / time.Duration(n)
 }
 
-func (p *Pool) Dial(proto, target string) (protocol.TCPConn, error) {
-	idleConn, err := p.Pick()
+func (p *Pool) getMuxSession(ctx context.Context) (*protocol.MuxSession, error) {
+	p.muxMutex.Lock()
+	defer p.muxMutex.Unlock()
+
+	p.mutex.RLock()
+	closed := p.closed
+	p.mutex.RUnlock()
+	if closed {
+		return nil, errors.New("pool closed")
+	}
+
+	if p.muxSession != nil && !p.muxSession.IsClosed() {
+		return p.muxSession, nil
+	}
+
+	s, err := p.dialer.DialMuxContext(ctx, p.proxy, p.auth)
 	if err != nil {
-		log.Printf("pick err: %v", err)
 		return nil, err
 	}
+	p.logInfof("mux added %s", s.Id())
+	p.muxSession = s
+	return s, nil
+}
 
-	if idleConn != nil {
-		return idleConn.Dial(proto, target)
+func (p *Pool) Dial(proto, target string) (protocol.TCPConn, error) {
+	return p.DialContext(context.Background(), proto, target)
+}
+
+// DialContext dials over an idle connection, or over the mux session if it's a mux pool.
+// If the idle connection turns out to be dead before anything is sent, another one is tried,
+// and a new connection is made at last.
+func (p *Pool) DialContext(ctx context.Context, proto, target string) (protocol.TCPConn, error) {
+	if p.balance != nil {
+		var conn protocol.TCPConn
+		err := p.route(ctx, func(mp *Pool) (err error) {
+			conn, err = mp.DialContext(ctx, proto, target)
+			return err
+		})
+		return conn, err
+	}
+	if p.mux && proto == protocol.ProtocolTCP {
+		s, err := p.getMuxSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return s.DialContext(ctx, proto, target)
 	}
 
-	return p.connectImmediately(proto, target)
+	var conn protocol.TCPConn
+	err := p.tryIdle(ctx, func(c *protocol.IdleConn) (err error) {
+		conn, err = c.DialContext(ctx, proto, target)
+		return err
+	})
+	if conn != nil || !errors.Is(err, protocol.ErrUseAnotherIdleConn) {
+		return conn, err
+	}
+	return p.dialer.DialContext(ctx, p.proxy, p.auth, proto, target)
+}
+
+func (p *Pool) DialUDP(target string) (protocol.UDPConn, error) {
+	return p.DialUDPContext(context.Background(), target)
+}
+
+// DialUDPContext is like DialContext, but for udp
+func (p *Pool) DialUDPContext(ctx context.Context, target string) (protocol.UDPConn, error) {
+	if p.balance != nil {
+		var conn protocol.UDPConn
+		err := p.route(ctx, func(mp *Pool) (err error) {
+			conn, err = mp.DialUDPContext(ctx, target)
+			return err
+		})
+		return conn, err
+	}
+	var conn protocol.UDPConn
+	err := p.tryIdle(ctx, func(c *protocol.IdleConn) (err error) {
+		conn, err = c.DialUDPContext(ctx, target)
+		return err
+	})
+	if conn != nil || !errors.Is(err, protocol.ErrUseAnotherIdleConn) {
+		return conn, err
+	}
+	return p.dialer.DialUDPContext(ctx, p.proxy, p.auth, target)
+}
+
+// tryIdle dials with idle connections until one is not stale, at most maxIdleAttempts of them.
+// It returns ErrUseAnotherIdleConn if a new connection should be made.
+func (p *Pool) tryIdle(ctx context.Context, dial func(*protocol.IdleConn) error) error {
+	for i := 0; i < maxIdleAttempts; i++ {
+		idleConn, err := p.Pick()
+		if err != nil {
+			p.logErrorf("pick err: %v", err)
+			return err
+		}
+		if idleConn == nil {
+			break
+		}
+
+		err = dial(idleConn)
+		if !errors.Is(err, protocol.ErrUseAnotherIdleConn) {
+			return err
+		}
+		p.logWarnf("idle conn %s stale: %v", idleConn.Id(), err)
+		p.mutex.Lock()
+		p.stats.Stale++
+		p.mutex.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return protocol.ErrUseAnotherIdleConn
 }
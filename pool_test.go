@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+	"weisuo/pool"
+	"weisuo/protocol"
+)
+
+func TestAdaptivePool(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10191", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		p := pool.MakeAdaptivePool("ws://127.0.0.1:10191/proxy", "12345",
+			pool.Options{MinIdle: 1, MaxIdle: 4, MaxIdleAge: time.Second}, protocol.DefaultDialer())
+		defer p.Close()
+
+		time.Sleep(300 * time.Millisecond)
+		if s := p.Stats(); s.Idle != 1 {
+			t.Errorf("unexpected idle conns: %+v", s)
+		}
+
+		// a burst of requests grows the pool
+		for i := 0; i < 30; i++ {
+			c, err := p.Pick()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if c != nil {
+				c.Close()
+			}
+		}
+		time.Sleep(300 * time.Millisecond)
+		s := p.Stats()
+		if s.Idle <= 1 || s.Idle > 4 {
+			t.Errorf("pool not grown: %+v", s)
+		}
+		if s.Hits == 0 || s.Misses == 0 || s.Hits+s.Misses != 30 {
+			t.Errorf("unexpected hits and misses: %+v", s)
+		}
+
+		// idle conns are rotated by age
+		time.Sleep(1200 * time.Millisecond)
+		s = p.Stats()
+		if s.Evictions == 0 || s.Idle == 0 {
+			t.Errorf("idle conns not rotated: %+v", s)
+		}
+		if s.ConnectFailures != 0 {
+			t.Errorf("unexpected connect failures: %+v", s)
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	// nothing listens on the port
+	p := pool.MakeAdaptivePool("ws://127.0.0.1:10192/proxy", "12345",
+		pool.Options{MinIdle: 4, MaxIdle: 4}, protocol.DefaultDialer())
+	time.Sleep(2 * time.Second)
+	s := p.Stats()
+	p.Close()
+
+	if s.ConnectFailures == 0 {
+		t.Errorf("no connect failures: %+v", s)
+	}
+	// attempts are one at a time after a failure, with the delay doubled
+	if s.ConnectFailures > 8 {
+		t.Errorf("too many connect attempts: %+v", s)
+	}
+}
+
+func TestPoolStaleRetry(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+
+		// the first 2 idle conns are dropped once requested, and idle conns of /slow never respond
+		var dropped int32
+		upgrader := &websocket.Upgrader{}
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(protocol.HeaderKeyTarget) != "" || atomic.AddInt32(&dropped, 1) > 2 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			header := make(http.Header)
+			header.Set(protocol.HeaderKeyId, xid.New().String())
+			ws, err := upgrader.Upgrade(w, r, header)
+			if err != nil {
+				return
+			}
+			_, _, _ = ws.ReadMessage()
+			ws.UnderlyingConn().Close()
+		}))
+		mux.Handle("/slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := make(http.Header)
+			header.Set(protocol.HeaderKeyId, xid.New().String())
+			ws, err := upgrader.Upgrade(w, r, header)
+			if err != nil {
+				return
+			}
+			defer ws.Close()
+			for {
+				_, _, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+			}
+		}))
+		err := http.ListenAndServe("127.0.0.1:10193", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10194")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		p := pool.MakePool("ws://127.0.0.1:10193/proxy", "12345", 2, protocol.DefaultDialer())
+		defer p.Close()
+		time.Sleep(500 * time.Millisecond)
+
+		conn, err := p.DialContext(context.Background(), "tcp", "127.0.0.1:10194")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		_, err = conn.Write([]byte("333"))
+		if err != nil {
+			errCh <- err
+			return
+		}
+		conn.CloseWrite()
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if !bytes.Equal(data, []byte("333")) {
+			t.Errorf("unexpected data: %q", data)
+		}
+		if s := p.Stats(); s.Stale != 2 {
+			t.Errorf("stale idle conns not retried: %+v", s)
+		}
+
+		// the response is waited until the deadline
+		c, err := protocol.DefaultDialer().DialIdle("ws://127.0.0.1:10193/slow", "12345", nil)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = c.DialContext(ctx, "tcp", "127.0.0.1:10194")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("request not canceled after %v", d)
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
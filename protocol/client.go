@@ -5,15 +5,28 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 	"weisuo/logger"
 )
 
+type AuthSignerFunc func(key, target string) string
+
 type Dialer struct {
 	WsDialer *websocket.Dialer
 	Logger   logger.Logger
 	LogLevel logger.LogLevel
+	// LogTarget transforms targets in logs, they are logged as they are if nil
+	LogTarget LogTargetFunc
+	// AuthSigner generates the authorization string for each request, the key is sent as it is if nil
+	AuthSigner AuthSignerFunc
+	// MaxPongMisses closes connections once pongs of so many pings in a row are missed, zero means never
+	MaxPongMisses int
+	// ObserveRTT is called with round-trip times measured by pings
+	ObserveRTT RTTFunc
+	Heartbeat  Heartbeat
 }
 
 func DefaultDialer() *Dialer {
@@ -23,8 +36,10 @@ func DefaultDialer() *Dialer {
 			ReadBufferSize:   16 * 1024,
 			WriteBufferSize:  16 * 1024,
 		},
-		Logger:   &logger.DefaultLogger{},
-		LogLevel: logger.LogLevelInfo,
+		Logger:        &logger.DefaultLogger{},
+		LogLevel:      logger.LogLevelInfo,
+		MaxPongMisses: 3,
+		Heartbeat:     DefaultHeartbeat(),
 	}
 }
 
@@ -33,35 +48,89 @@ func (d *Dialer) Dial(proxy, auth, proto, target string) (TCPConn, error) {
 }
 
 func (d *Dialer) DialContext(ctx context.Context, proxy, auth, proto, target string) (TCPConn, error) {
+	ws, id, err := d.dialWebsocket(ctx, proxy, auth, proto, target)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connTcp{
+		id:       id,
+		ws:       ws,
+		pong:     newPongTracker(ws, d.MaxPongMisses, d.ObserveRTT),
+		logger:   d.Logger,
+		logLevel: d.LogLevel,
+	}
+	// pongs are handled only while the application reads
+	c.pong.setReading(false)
+
+	go c.pinger(d.Heartbeat)
+
+	c.logInfof("connected %s", logTarget(d.LogTarget, target))
+
+	return c, nil
+}
+
+func (d *Dialer) DialUDP(proxy, auth, target string) (UDPConn, error) {
+	return d.DialUDPContext(context.Background(), proxy, auth, target)
+}
+
+func (d *Dialer) DialUDPContext(ctx context.Context, proxy, auth, target string) (UDPConn, error) {
+	ws, id, err := d.dialWebsocket(ctx, proxy, auth, ProtocolUDP, target)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connUdp{
+		id:       id,
+		ws:       ws,
+		target:   udpAddr(target),
+		pong:     newPongTracker(ws, d.MaxPongMisses, d.ObserveRTT),
+		logger:   d.Logger,
+		logLevel: d.LogLevel,
+	}
+
+	go c.pinger(d.Heartbeat)
+
+	c.logInfof("connected udp %s", logTarget(d.LogTarget, target))
+
+	return c, nil
+}
+
+func (d *Dialer) dialWebsocket(ctx context.Context, proxy, auth, proto, target string) (*websocket.Conn, xid.ID, error) {
+	if d.AuthSigner != nil {
+		auth = d.AuthSigner(auth, target)
+	}
+
 	reqHeader := make(http.Header)
 	reqHeader.Set(HeaderKeyAuth, auth)
-	reqHeader.Set(HeaderKeyProtocol, proto)
-	reqHeader.Set(HeaderKeyTarget, target)
+	if proto != "" {
+		reqHeader.Set(HeaderKeyProtocol, proto)
+	}
+	if target != "" {
+		reqHeader.Set(HeaderKeyTarget, target)
+	}
 
 	ws, wsResp, err := d.WsDialer.DialContext(ctx, proxy, reqHeader)
 	if err != nil {
 		status := ""
 		if wsResp != nil {
 			status = wsResp.Status
+			if codeStr := wsResp.Header.Get(HeaderKeyError); codeStr != "" {
+				body, _ := io.ReadAll(wsResp.Body)
+				return nil, xid.NilID(), &DialError{
+					Code:    parseErrorCode(codeStr),
+					Message: fmt.Sprintf("dial websocket failure: %v (%s) %s", err, status, strings.TrimSpace(string(body))),
+				}
+			}
 		}
-		return nil, fmt.Errorf("dial websocket failure: %v (%s)", err, status)
+		return nil, xid.NilID(), fmt.Errorf("dial websocket failure: %v (%s)", err, status)
 	}
 	idString := wsResp.Header.Get(HeaderKeyId)
 	id, err := xid.FromString(idString)
 	if err != nil {
-		return nil, fmt.Errorf("unexpected response value of %s: `%s`", HeaderKeyId, idString)
+		ws.Close()
+		return nil, xid.NilID(), fmt.Errorf("unexpected response value of %s: `%s`", HeaderKeyId, idString)
 	}
 
-	c := &connTcp{
-		id:       id,
-		ws:       ws,
-		logger:   d.Logger,
-		logLevel: d.LogLevel,
-	}
-
-	go c.pinger()
-
-	c.logInfof("connected %s", target)
-
-	return c, nil
+	return ws, id, nil
 }
@@ -0,0 +1,59 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// Check verifies the endpoint by the handshake of an idle connection and a ping on it,
+// returns the round-trip time of the ping
+func (d *Dialer) Check(ctx context.Context, proxy, auth string) (time.Duration, error) {
+	ws, _, err := d.dialWebsocket(ctx, proxy, auth, "", "")
+	if err != nil {
+		return 0, err
+	}
+	defer ws.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok && d.WsDialer.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(d.WsDialer.HandshakeTimeout)
+	}
+	pong := make(chan struct{}, 1)
+	ws.SetPongHandler(func(string) error {
+		select {
+		case pong <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	_ = ws.SetReadDeadline(deadline)
+	// pongs are handled while reading, the server sends nothing else to an idle conn
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := ws.ReadMessage()
+		readErr <- err
+	}()
+
+	start := time.Now()
+	err = ws.WriteControl(websocket.PingMessage, nil, deadline)
+	if err != nil {
+		return 0, fmt.Errorf("send ping failure: %v", err)
+	}
+	select {
+	case <-pong:
+	case err := <-readErr:
+		return 0, fmt.Errorf("read pong failure: %v", err)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	rtt := time.Since(start)
+
+	_ = ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "ok"),
+		time.Now().Add(time.Second),
+	)
+	return rtt, nil
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
-	"net/http"
 	"sync"
 	"time"
 )
@@ -22,6 +21,15 @@ type IdleConn struct {
 	idle  bool
 	mutex sync.RWMutex
 	errCb func(*IdleConn)
+	pong  *pongTracker
+	// resp receives the first message read, which is the response of the request
+	resp chan idleResp
+}
+
+type idleResp struct {
+	mt  int
+	buf []byte
+	err error
 }
 
 func (d *Dialer) DialIdle(proxy, auth string, errCb func(*IdleConn)) (*IdleConn, error) {
@@ -29,21 +37,9 @@ func (d *Dialer) DialIdle(proxy, auth string, errCb func(*IdleConn)) (*IdleConn,
 }
 
 func (d *Dialer) DialIdleContext(ctx context.Context, proxy, auth string, errCb func(*IdleConn)) (*IdleConn, error) {
-	reqHeader := make(http.Header)
-	reqHeader.Set(HeaderKeyAuth, auth)
-
-	ws, wsResp, err := d.WsDialer.DialContext(ctx, proxy, reqHeader)
-	if err != nil {
-		status := ""
-		if wsResp != nil {
-			status = wsResp.Status
-		}
-		return nil, fmt.Errorf("dial websocket failure: %v (%s)", err, status)
-	}
-	idString := wsResp.Header.Get(HeaderKeyId)
-	id, err := xid.FromString(idString)
+	ws, id, err := d.dialWebsocket(ctx, proxy, auth, "", "")
 	if err != nil {
-		return nil, fmt.Errorf("unexpected response value of %s: `%s`", HeaderKeyId, idString)
+		return nil, err
 	}
 
 	c := &IdleConn{
@@ -52,53 +48,98 @@ func (d *Dialer) DialIdleContext(ctx context.Context, proxy, auth string, errCb
 		ws:    ws,
 		idle:  true,
 		errCb: errCb,
+		pong:  newPongTracker(ws, d.MaxPongMisses, d.ObserveRTT),
+		resp:  make(chan idleResp, 1),
 	}
+	go c.reader()
 	go c.pinger()
 
 	return c, nil
 }
 
-func (c *IdleConn) pinger() {
-	n := 0
-	for {
-		time.Sleep(time.Second)
+// reader reads the response of the request, so that pongs and closing by the server are handled while idle
+func (c *IdleConn) reader() {
+	mt, buf, err := c.ws.ReadMessage()
+	// sent before locking c.mutex, which is held by request waiting for it
+	c.resp <- idleResp{mt: mt, buf: buf, err: err}
+	if err == nil {
+		return
+	}
 
-		c.mutex.RLock()
-		idle := c.idle
-		c.mutex.RUnlock()
-		if !idle {
-			break
+	c.mutex.Lock()
+	idle := c.idle
+	c.idle = false
+	c.mutex.Unlock()
+	if idle {
+		c.d.Logger.Info(fmt.Sprintf("idle conn closed: %s %v", c.id.String(), err))
+		_ = c.ws.Close()
+		if c.errCb != nil {
+			c.errCb(c)
 		}
+	}
+}
 
-		n++
-		if n < 27 {
-			continue
-		}
-		n = 0
+func (c *IdleConn) pinger() {
+	err := c.d.Heartbeat.run(func() bool {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		return !c.idle
+	}, c.ping, c.keepalive)
+	if err == nil {
+		return
+	}
+	if errors.Is(err, errPongTimeout) {
+		c.d.Logger.Warn(fmt.Sprintf("pong timeout on idle conn: %s %d pings missed", c.id.String(), c.pong.missed()))
+	} else {
+		c.d.Logger.Error(fmt.Sprintf("send ping failure on idle conn: %s %v", c.id.String(), err))
+	}
 
-		c.mutex.Lock()
-		if !idle {
-			c.mutex.Unlock()
-			break
-		}
-		err := c.ws.WriteMessage(websocket.PingMessage, nil)
-		if err != nil {
-			c.d.Logger.Error(fmt.Sprintf("send ping failure on idle conn: %s %v", c.id.String(), err))
-			if c.errCb != nil {
-				c.errCb(c)
-			}
-			c.idle = false
-			c.mutex.Unlock()
-			break
+	c.mutex.Lock()
+	idle := c.idle
+	c.idle = false
+	c.mutex.Unlock()
+	if idle {
+		_ = c.ws.Close()
+		if c.errCb != nil {
+			c.errCb(c)
 		}
-		c.mutex.Unlock()
 	}
 }
 
+// ping sends a ping while idle, c.mutex is held so that it's not sent in the middle of a request
+func (c *IdleConn) ping() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.idle {
+		return nil
+	}
+	payload, ok := c.pong.next()
+	if !ok {
+		return errPongTimeout
+	}
+	return c.ws.WriteMessage(websocket.PingMessage, payload)
+}
+
+func (c *IdleConn) keepalive() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.idle {
+		return nil
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(keepaliveMessage))
+}
+
 func (c *IdleConn) Close() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	if c.idle {
+		_ = c.ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "ok"),
+			time.Now().Add(time.Second),
+		)
+	}
 	c.idle = false
 
 	return c.ws.Close()
@@ -113,46 +154,138 @@ func (c *IdleConn) Id() string {
 	return c.id.String()
 }
 
+// RTT returns the round-trip time measured by pings, or zero if not measured yet
+func (c *IdleConn) RTT() time.Duration {
+	return c.pong.lastRTT()
+}
+
 func (c *IdleConn) Dial(proto, target string) (TCPConn, error) {
+	return c.DialContext(context.Background(), proto, target)
+}
+
+// DialContext turns the idle conn into a tcp one. Errors wrapping ErrUseAnotherIdleConn mean nothing of
+// the tunnel has been sent, so the request can be retried on another conn.
+func (c *IdleConn) DialContext(ctx context.Context, proto, target string) (TCPConn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	err := c.request(ctx, proto, target)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &connTcp{
+		id:       c.id,
+		ws:       c.ws,
+		pong:     c.pong,
+		logger:   c.d.Logger,
+		logLevel: c.d.LogLevel,
+	}
+	cc.init()
+	// pongs are handled only while the application reads, the reader of the idle conn has finished
+	cc.pong.setReading(false)
+	go cc.pinger(c.d.Heartbeat)
+
+	cc.logInfof("connected %s", logTarget(c.d.LogTarget, target))
+
+	return cc, nil
+}
+
+func (c *IdleConn) DialUDP(target string) (UDPConn, error) {
+	return c.DialUDPContext(context.Background(), target)
+}
+
+// DialUDPContext turns the idle conn into a udp one, errors are like DialContext
+func (c *IdleConn) DialUDPContext(ctx context.Context, target string) (UDPConn, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	err := c.request(ctx, ProtocolUDP, target)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &connUdp{
+		id:       c.id,
+		ws:       c.ws,
+		target:   udpAddr(target),
+		pong:     c.pong,
+		logger:   c.d.Logger,
+		logLevel: c.d.LogLevel,
+	}
+	go cc.pinger(c.d.Heartbeat)
+
+	cc.logInfof("connected udp %s", logTarget(c.d.LogTarget, target))
+
+	return cc, nil
+}
+
+// request turns the idle conn into an active one, c.mutex must be held.
+// The response is waited until the deadline of ctx, or HandshakeTimeout of WsDialer if ctx has none.
+func (c *IdleConn) request(ctx context.Context, proto, target string) error {
 	if !c.idle {
-		return nil, ErrUseAnotherIdleConn
+		return ErrUseAnotherIdleConn
 	}
 	c.idle = false
 
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline && c.d.WsDialer.HandshakeTimeout > 0 {
+		deadline = time.Now().Add(c.d.WsDialer.HandshakeTimeout)
+	}
+	_ = c.ws.SetWriteDeadline(deadline)
 	err := c.ws.WriteJSON(&reqMessage{
 		Protocol: proto,
 		Target:   target,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("send req failure: %v", err)
+		_ = c.ws.Close()
+		return fmt.Errorf("%w: send req failure: %v", ErrUseAnotherIdleConn, err)
 	}
+	_ = c.ws.SetWriteDeadline(time.Time{})
 
-	mt, buf, err := c.ws.ReadMessage()
+	// the deadline of ctx is reported by ctx.Err
+	var timeout <-chan time.Time
+	if !hasDeadline && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var resp idleResp
+	select {
+	case resp = <-c.resp:
+	case <-ctx.Done():
+		_ = c.ws.Close()
+		return ctx.Err()
+	case <-timeout:
+		_ = c.ws.Close()
+		return &DialError{Code: ErrorCodeTimeout, Message: "read resp failure: timeout"}
+	}
+
+	mt, buf, err := resp.mt, resp.buf, resp.err
 	if err != nil {
-		return nil, fmt.Errorf("read resp failure: %v", err)
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Code == websocket.CloseGoingAway {
+			// the server is shutting down, and the request is not handled
+			_ = c.ws.Close()
+			return ErrUseAnotherIdleConn
+		}
+		if errors.As(err, &closeErr) && closeErr.Code >= ErrorCodeFailure {
+			return &DialError{
+				Code:    validErrorCode(closeErr.Code),
+				Message: fmt.Sprintf("read resp failure: %v", err),
+			}
+		}
+		// the conn is dead, nothing of the tunnel has been sent yet
+		return fmt.Errorf("%w: read resp failure: %v", ErrUseAnotherIdleConn, err)
 	}
 	if mt != websocket.TextMessage {
-		return nil, fmt.Errorf("unexpected resp type: %d", mt)
+		return fmt.Errorf("unexpected resp type: %d", mt)
 	}
 
 	respStr := string(buf)
 	if respStr != "ok" {
-		return nil, fmt.Errorf("cannot open: %s", respStr)
+		return fmt.Errorf("cannot open: %s", respStr)
 	}
 
-	cc := &connTcp{
-		id:       c.id,
-		ws:       c.ws,
-		logger:   c.d.Logger,
-		logLevel: c.d.LogLevel,
-	}
-	cc.init()
-	go cc.pinger()
-
-	cc.logInfof("connected %s", target)
-
-	return cc, nil
+	return nil
 }
@@ -0,0 +1,26 @@
+package protocol
+
+import (
+	"context"
+)
+
+func (d *Dialer) DialMux(proxy, auth string) (*MuxSession, error) {
+	return d.DialMuxContext(context.Background(), proxy, auth)
+}
+
+// DialMuxContext establishes a long-lived WebSocket connection, which carries many streams
+func (d *Dialer) DialMuxContext(ctx context.Context, proxy, auth string) (*MuxSession, error) {
+	ws, id, err := d.dialWebsocket(ctx, proxy, auth, ProtocolMux, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s := newMuxSession(id, ws, true, d.Logger, d.LogLevel, d.LogTarget)
+	s.pong = newPongTracker(ws, d.MaxPongMisses, d.ObserveRTT)
+	go s.readLoop()
+	go s.pinger(d.Heartbeat)
+
+	s.logInfof("mux connected")
+
+	return s, nil
+}
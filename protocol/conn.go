@@ -33,6 +33,8 @@ type connTcp struct {
 	closeWrite uint32
 	closeRead  uint32
 	closeOnce  sync.Once
+	// pong is nil on server, which sends no pings
+	pong *pongTracker
 
 	logger   logger.Logger
 	logLevel logger.LogLevel
@@ -93,7 +95,12 @@ func (c *connTcp) Read(buf []byte) (k int, e error) {
 		return n, nil
 	}
 
-	_, data, err := c.ws.ReadMessage()
+	c.pong.setReading(true)
+	mt, data, err := c.ws.ReadMessage()
+	for err == nil && isKeepalive(mt, data) {
+		mt, data, err = c.ws.ReadMessage()
+	}
+	c.pong.setReading(false)
 	if err != nil {
 		c.errHandle()
 		return 0, err
@@ -103,6 +110,9 @@ func (c *connTcp) Read(buf []byte) (k int, e error) {
 		c.setReadClosed()
 
 		c.logDebugf("read EOF")
+		if c.pong != nil && !c.isWriteClosed() {
+			go c.readControl()
+		}
 		defer c.checkClose()
 		return 0, io.EOF
 	}
@@ -205,33 +215,63 @@ func (c *connTcp) close() error {
 	return err
 }
 
-func (c *connTcp) pinger() {
-	lastPingTime := time.Now()
+// readControl keeps reading after the read EOF, so that pongs and closing are handled while still writing
+func (c *connTcp) readControl() {
+	c.pong.setReading(true)
+	defer c.pong.setReading(false)
 	for {
-		time.Sleep(time.Second)
-
-		if c.isWriteClosed() && c.isReadClosed() {
-			c.logDebugf("ping stopped")
-			break
+		_, _, err := c.ws.ReadMessage()
+		if err != nil {
+			c.logDebugf("read after EOF: %v", err)
+			return
 		}
+	}
+}
 
-		if time.Now().Sub(lastPingTime) > time.Second*27 {
-			err := c.ping()
-			if err != nil {
-				c.logDebugf("ping err, stop: %v", err)
-				c.errHandle()
-				break
-			}
-			lastPingTime = time.Now()
-		}
+func (c *connTcp) pinger(hb Heartbeat) {
+	err := hb.run(func() bool {
+		return c.isWriteClosed() && c.isReadClosed()
+	}, c.ping, c.keepalive)
+	if errors.Is(err, errPongTimeout) {
+		c.logWarnf("pong timeout, %d pings missed", c.pong.missed())
+		c.errHandle()
+		_ = c.ws.Close()
+		return
 	}
+	if err != nil {
+		c.logDebugf("ping err, stop: %v", err)
+		c.errHandle()
+		return
+	}
+	c.logDebugf("ping stopped")
 }
 
 func (c *connTcp) ping() error {
+	payload, ok := c.pong.next()
+	if !ok {
+		return errPongTimeout
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.ws.WriteMessage(websocket.PingMessage, payload)
+}
+
+// keepalive sends a keepalive message unless the write is closed, after which the server stops reading
+func (c *connTcp) keepalive() error {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
 
-	return c.ws.WriteMessage(websocket.PingMessage, nil)
+	if c.isWriteClosed() {
+		return nil
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(keepaliveMessage))
+}
+
+// RTT returns the round-trip time measured by pings, or zero if not measured yet
+func (c *connTcp) RTT() time.Duration {
+	return c.pong.lastRTT()
 }
 
 func (c *connTcp) LocalAddr() net.Addr {
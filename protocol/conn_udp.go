@@ -0,0 +1,193 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"weisuo/logger"
+)
+
+// UDPConn is a udp tunnel, each binary WebSocket message carries exactly one datagram.
+// The tunnel is bound to the target given when dialing.
+type UDPConn interface {
+	net.Conn
+	net.PacketConn
+}
+
+type udpAddr string
+
+func (a udpAddr) Network() string {
+	return ProtocolUDP
+}
+
+func (a udpAddr) String() string {
+	return string(a)
+}
+
+type connUdp struct {
+	id         xid.ID
+	ws         *websocket.Conn
+	target     udpAddr
+	writeMutex sync.Mutex
+	closed     uint32
+	closeOnce  sync.Once
+	pong       *pongTracker
+
+	logger   logger.Logger
+	logLevel logger.LogLevel
+}
+
+func (c *connUdp) isClosed() bool {
+	return atomic.LoadUint32(&c.closed) > 0
+}
+func (c *connUdp) setClosed() {
+	atomic.StoreUint32(&c.closed, 1)
+}
+
+// Read reads one datagram, the datagram is truncated if buf is too small
+func (c *connUdp) Read(buf []byte) (int, error) {
+	if c.isClosed() {
+		return 0, errors.New("conn already closed")
+	}
+
+	for {
+		mt, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.setClosed()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				c.logDebugf("read EOF")
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+
+		n := copy(buf, data)
+		if n < len(data) {
+			c.logDebugf("datagram truncated: %d > %d", len(data), n)
+		}
+		return n, nil
+	}
+}
+
+func (c *connUdp) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, err := c.Read(buf)
+	return n, c.target, err
+}
+
+func (c *connUdp) Write(buf []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.isClosed() {
+		return 0, errors.New("conn already closed")
+	}
+
+	err := c.ws.WriteMessage(websocket.BinaryMessage, buf)
+	if err != nil {
+		c.logErrorf("write err: %v", err)
+		c.setClosed()
+		return 0, fmt.Errorf("write err: %v", err)
+	}
+
+	return len(buf), nil
+}
+
+func (c *connUdp) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	if addr != nil && addr.String() != c.target.String() {
+		return 0, fmt.Errorf("udp tunnel is bound to %s, cannot write to %s", c.target, addr)
+	}
+	return c.Write(buf)
+}
+
+func (c *connUdp) Close() error {
+	c.logDebugf("close")
+
+	err := errors.New("already closed")
+	c.closeOnce.Do(func() {
+		c.setClosed()
+
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+
+		_ = c.ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "ok"),
+			time.Now().Add(time.Second),
+		)
+		err = c.ws.Close()
+	})
+	return err
+}
+
+func (c *connUdp) pinger(hb Heartbeat) {
+	err := hb.run(c.isClosed, c.ping, c.keepalive)
+	if errors.Is(err, errPongTimeout) {
+		c.logWarnf("pong timeout, %d pings missed", c.pong.missed())
+		c.setClosed()
+		_ = c.ws.Close()
+		return
+	}
+	if err != nil {
+		c.logDebugf("ping err, stop: %v", err)
+		c.setClosed()
+		return
+	}
+	c.logDebugf("ping stopped")
+}
+
+func (c *connUdp) ping() error {
+	payload, ok := c.pong.next()
+	if !ok {
+		return errPongTimeout
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.ws.WriteMessage(websocket.PingMessage, payload)
+}
+
+func (c *connUdp) keepalive() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	return c.ws.WriteMessage(websocket.TextMessage, []byte(keepaliveMessage))
+}
+
+// RTT returns the round-trip time measured by pings, or zero if not measured yet
+func (c *connUdp) RTT() time.Duration {
+	return c.pong.lastRTT()
+}
+
+func (c *connUdp) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *connUdp) RemoteAddr() net.Addr {
+	return c.target
+}
+
+func (c *connUdp) SetDeadline(t time.Time) error {
+	err := c.ws.SetWriteDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *connUdp) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *connUdp) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -5,5 +5,14 @@ const (
 	HeaderKeyProtocol = "X-PROXY-Protocol"
 	HeaderKeyTarget   = "X-PROXY-Target"
 
-	HeaderKeyId = "X-PROXY-ID"
+	HeaderKeyId    = "X-PROXY-ID"
+	HeaderKeyError = "X-PROXY-Error"
+)
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+
+	// ProtocolMux is only used in handshake, streams of a mux session are tcp
+	ProtocolMux = "mux"
 )
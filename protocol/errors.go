@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+// Error codes of failures, sent in the header X-PROXY-Error of a common connection,
+// as the close code of an idle connection, or in the reset frame of a mux stream.
+// They are in the range of private WebSocket close codes.
+const (
+	ErrorCodeFailure         = 4000
+	ErrorCodeNotAllowed      = 4001
+	ErrorCodeRefused         = 4002
+	ErrorCodeNetUnreachable  = 4003
+	ErrorCodeHostUnreachable = 4004
+	ErrorCodeTimeout         = 4005
+	ErrorCodeUnsupported     = 4006
+	ErrorCodeQuotaExceeded   = 4007
+	ErrorCodeLimitExceeded   = 4008
+)
+
+// DialError is returned if the server reports why it fails to handle the request
+type DialError struct {
+	Code    int
+	Message string
+}
+
+func (e *DialError) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the error code reported by the server, or ErrorCodeFailure if unknown
+func ErrorCode(err error) int {
+	var dialErr *DialError
+	if errors.As(err, &dialErr) {
+		return dialErr.Code
+	}
+	var streamErr *StreamError
+	if errors.As(err, &streamErr) {
+		return streamErr.Code
+	}
+	return ErrorCodeFailure
+}
+
+// validErrorCode returns ErrorCodeFailure if the code is unknown
+func validErrorCode(code int) int {
+	if code < ErrorCodeFailure || code > ErrorCodeLimitExceeded {
+		return ErrorCodeFailure
+	}
+	return code
+}
+
+func parseErrorCode(s string) int {
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return ErrorCodeFailure
+	}
+	return validErrorCode(code)
+}
+
+// dialErrorCode classifies failures of connecting targets
+func dialErrorCode(err error) int {
+	if errors.Is(err, ErrTargetNotAllowed) {
+		return ErrorCodeNotAllowed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrorCodeRefused
+	}
+	if errors.Is(err, syscall.ENETUNREACH) {
+		return ErrorCodeNetUnreachable
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) {
+		return ErrorCodeHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return ErrorCodeTimeout
+		}
+		return ErrorCodeHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorCodeTimeout
+	}
+	return ErrorCodeFailure
+}
+
+func errorCodeStatus(code int) int {
+	switch code {
+	case ErrorCodeNotAllowed, ErrorCodeQuotaExceeded:
+		return http.StatusForbidden
+	case ErrorCodeTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorCodeUnsupported:
+		return http.StatusBadRequest
+	case ErrorCodeLimitExceeded:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"time"
+)
+
+// keepaliveMessage is sent as a text message in band, which is skipped by servers
+const keepaliveMessage = "keepalive"
+
+// Heartbeat schedules pings and keepalive messages of client connections
+type Heartbeat struct {
+	// PingInterval is the interval of WebSocket pings
+	PingInterval time.Duration
+	// Jitter randomizes each interval within ±Jitter, so that there is no fixed pattern
+	Jitter time.Duration
+	// KeepaliveInterval is the interval of keepalive data messages, for intermediaries swallowing control frames.
+	// Zero means no keepalive messages, which are not understood by old servers.
+	KeepaliveInterval time.Duration
+}
+
+func DefaultHeartbeat() Heartbeat {
+	return Heartbeat{
+		PingInterval: 25 * time.Second,
+		Jitter:       5 * time.Second,
+	}
+}
+
+// next returns the time of the next message sent in the interval
+func (hb Heartbeat) next(interval time.Duration) time.Time {
+	d := interval
+	if hb.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*hb.Jitter+1))) - hb.Jitter
+	}
+	if d < interval/2 {
+		d = interval / 2
+	}
+	return time.Now().Add(d)
+}
+
+// run sends pings and keepalive messages until closed returns true or sending fails
+func (hb Heartbeat) run(closed func() bool, ping func() error, keepalive func() error) error {
+	if hb.PingInterval <= 0 {
+		hb.PingInterval = DefaultHeartbeat().PingInterval
+	}
+	nextPing := hb.next(hb.PingInterval)
+	var nextKeepalive time.Time
+	if hb.KeepaliveInterval > 0 {
+		nextKeepalive = hb.next(hb.KeepaliveInterval)
+	}
+
+	for {
+		wait := time.Until(nextPing)
+		if hb.KeepaliveInterval > 0 && time.Until(nextKeepalive) < wait {
+			wait = time.Until(nextKeepalive)
+		}
+		// check closed at least every second
+		if wait > time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+
+		if closed() {
+			return nil
+		}
+		now := time.Now()
+		if !now.Before(nextPing) {
+			err := ping()
+			if err != nil {
+				return err
+			}
+			nextPing = hb.next(hb.PingInterval)
+		}
+		if hb.KeepaliveInterval > 0 && !now.Before(nextKeepalive) {
+			err := keepalive()
+			if err != nil {
+				return err
+			}
+			nextKeepalive = hb.next(hb.KeepaliveInterval)
+		}
+	}
+}
+
+func isKeepalive(mt int, data []byte) bool {
+	return mt == websocket.TextMessage && string(data) == keepaliveMessage
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errTooManyHandshakes = errors.New("too many handshakes")
+	errTooManyTunnels    = errors.New("too many tunnels of the user")
+	errTooManyIdle       = errors.New("too many idle connections")
+	errTooManyToTarget   = errors.New("too many tunnels to the target")
+)
+
+// LimitConfig caps concurrent connections, zero means unlimited
+type LimitConfig struct {
+	// MaxHandshakes limits requests being authorized, upgraded or connecting targets
+	MaxHandshakes int
+	// MaxTunnelsPerUser limits tunnels carrying data of each user, a stream of a mux connection is a tunnel
+	MaxTunnelsPerUser int
+	MaxIdlePerUser    int
+	MaxIdlePerIp      int
+	// MaxTunnelsPerTarget limits tunnels to each target of all users
+	MaxTunnelsPerTarget int
+}
+
+// Limits counts connections of a server, which are kept across reloads. Methods are no-op on nil.
+type Limits struct {
+	mutex      sync.Mutex
+	config     LimitConfig
+	handshakes int
+	tunnels    map[string]int
+	idleUsers  map[string]int
+	idleIps    map[string]int
+	targets    map[string]int
+}
+
+func NewLimits() *Limits {
+	return &Limits{
+		tunnels:   make(map[string]int),
+		idleUsers: make(map[string]int),
+		idleIps:   make(map[string]int),
+		targets:   make(map[string]int),
+	}
+}
+
+// SetConfig changes the limits, connections exceeding new limits are kept
+func (l *Limits) SetConfig(c LimitConfig) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.config = c
+}
+
+// noop is returned as the release function on nil
+func noop() {}
+
+// startHandshake returns the function to call once the handshake ends
+func (l *Limits) startHandshake() (func(), error) {
+	if l == nil {
+		return noop, nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.config.MaxHandshakes > 0 && l.handshakes >= l.config.MaxHandshakes {
+		return nil, errTooManyHandshakes
+	}
+	l.handshakes++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.handshakes--
+		})
+	}, nil
+}
+
+// addIdle returns the function to call once the idle connection gets a request or is closed
+func (l *Limits) addIdle(user, ip string) (func(), error) {
+	if l == nil {
+		return noop, nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if exceeded(l.idleUsers, user, l.config.MaxIdlePerUser) || exceeded(l.idleIps, ip, l.config.MaxIdlePerIp) {
+		return nil, errTooManyIdle
+	}
+	l.idleUsers[user]++
+	l.idleIps[ip]++
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		decrease(l.idleUsers, user)
+		decrease(l.idleIps, ip)
+	}, nil
+}
+
+// addTunnel returns the function to call once the tunnel is closed
+func (l *Limits) addTunnel(user, target string) (func(), error) {
+	if l == nil {
+		return noop, nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if exceeded(l.tunnels, user, l.config.MaxTunnelsPerUser) {
+		return nil, errTooManyTunnels
+	}
+	if exceeded(l.targets, target, l.config.MaxTunnelsPerTarget) {
+		return nil, errTooManyToTarget
+	}
+	l.tunnels[user]++
+	l.targets[target]++
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		decrease(l.tunnels, user)
+		decrease(l.targets, target)
+	}, nil
+}
+
+func exceeded(counts map[string]int, key string, max int) bool {
+	return max > 0 && counts[key] >= max
+}
+
+// decrease decreases the count, and removes it at zero so that the map does not grow
+func decrease(counts map[string]int, key string) {
+	counts[key]--
+	if counts[key] <= 0 {
+		delete(counts, key)
+	}
+}
@@ -1,59 +1,178 @@
 package protocol
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
 	"runtime"
 	"weisuo/logger"
 )
 
+// output logs the message with fields if l is a logger.StructuredLogger, otherwise with the text prefix
+func output(l logger.Logger, level logger.LogLevel, prefix string, fields []logger.Field, message string) {
+	if sl, ok := l.(logger.StructuredLogger); ok {
+		sl.Log(level, message, fields...)
+		return
+	}
+	logger.Write(l, level, prefix+message)
+}
+
+// caller returns the position of the caller of a log function
+func caller() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		file = "unknown"
+		line = 0
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+func (req *request) logTarget(target string) string {
+	return logTarget(req.h.LogTarget, target)
+}
+
+// logHeader returns the request header for logs, secrets and the target are masked
+func (req *request) logHeader() http.Header {
+	h := redactHeader(req.r.Header)
+	if target := h.Get(HeaderKeyTarget); target != "" {
+		h.Set(HeaderKeyTarget, req.logTarget(target))
+	}
+	return h
+}
+
+// logError returns err for logs, in which the host of the target is transformed like logTarget
+func (req *request) logError(err error, target string) error {
+	if req.h.LogTarget == nil {
+		return err
+	}
+	return errors.New(HideTargetHost(req.h.LogTarget, err.Error(), target))
+}
+
+// who returns the real ip, and the user if known
+func (req *request) who() string {
+	if req.user == "" {
+		return req.realIp
+	}
+	return req.realIp + " " + req.user
+}
+
+func (req *request) fields(extra ...logger.Field) []logger.Field {
+	fields := []logger.Field{
+		logger.F("id", req.id.String()),
+		logger.F("real_ip", req.realIp),
+	}
+	if req.user != "" {
+		fields = append(fields, logger.F("user", req.user))
+	}
+	if req.target != "" {
+		fields = append(fields, logger.F("protocol", req.proto), logger.F("target", req.logTarget(req.target)))
+	}
+	return append(fields, extra...)
+}
+
+// reqLog logs with extra fields, which are omitted in the text format
+type reqLog struct {
+	req    *request
+	fields []logger.Field
+}
+
+func (req *request) with(fields ...logger.Field) *reqLog {
+	return &reqLog{req: req, fields: fields}
+}
+
+func (l *reqLog) log(level logger.LogLevel, format string, a ...interface{}) {
+	req := l.req
+	if req.h.Logger != nil && req.h.LogLevel >= level {
+		prefix := fmt.Sprintf("S %s %s ", req.id.String(), req.who())
+		output(req.h.Logger, level, prefix, req.fields(l.fields...), fmt.Sprintf(format, a...))
+	}
+}
+func (l *reqLog) logInfof(format string, a ...interface{}) {
+	l.log(logger.LogLevelInfo, format, a...)
+}
+func (l *reqLog) logWarnf(format string, a ...interface{}) {
+	l.log(logger.LogLevelWarn, format, a...)
+}
+func (l *reqLog) logErrorf(format string, a ...interface{}) {
+	l.log(logger.LogLevelError, format, a...)
+}
+
 func (req *request) logDebugf(format string, a ...interface{}) {
 	if req.h.Logger != nil && req.h.LogLevel >= logger.LogLevelDebug {
-		_, file, line, ok := runtime.Caller(1)
-		if !ok {
-			file = "unknown"
-			line = 0
-		}
-		req.h.Logger.Debug(fmt.Sprintf("S %s %s:%d %s ", req.id.String(), file, line, req.realIp) + fmt.Sprintf(format, a...))
+		pos := caller()
+		prefix := fmt.Sprintf("S %s %s %s ", req.id.String(), pos, req.who())
+		output(req.h.Logger, logger.LogLevelDebug, prefix, req.fields(logger.F("caller", pos)), fmt.Sprintf(format, a...))
 	}
 }
 func (req *request) logInfof(format string, a ...interface{}) {
-	if req.h.Logger != nil && req.h.LogLevel >= logger.LogLevelInfo {
-		req.h.Logger.Info(fmt.Sprintf("S %s %s ", req.id.String(), req.realIp) + fmt.Sprintf(format, a...))
-	}
+	req.with().log(logger.LogLevelInfo, format, a...)
 }
 func (req *request) logWarnf(format string, a ...interface{}) {
-	if req.h.Logger != nil && req.h.LogLevel >= logger.LogLevelWarn {
-		req.h.Logger.Warn(fmt.Sprintf("S %s %s ", req.id.String(), req.realIp) + fmt.Sprintf(format, a...))
-	}
+	req.with().log(logger.LogLevelWarn, format, a...)
 }
 func (req *request) logErrorf(format string, a ...interface{}) {
-	if req.h.Logger != nil && req.h.LogLevel >= logger.LogLevelError {
-		req.h.Logger.Error(fmt.Sprintf("S %s %s ", req.id.String(), req.realIp) + fmt.Sprintf(format, a...))
-	}
+	req.with().log(logger.LogLevelError, format, a...)
 }
 
+func (c *connTcp) log(level logger.LogLevel, format string, a ...interface{}) {
+	if c.logger != nil && c.logLevel >= level {
+		output(c.logger, level, c.id.String()+" ", []logger.Field{logger.F("id", c.id.String())}, fmt.Sprintf(format, a...))
+	}
+}
 func (c *connTcp) logDebugf(format string, a ...interface{}) {
 	if c.logger != nil && c.logLevel >= logger.LogLevelDebug {
-		_, file, line, ok := runtime.Caller(1)
-		if !ok {
-			file = "unknown"
-			line = 0
-		}
-		c.logger.Debug(fmt.Sprintf("%s %s:%d ", c.id.String(), file, line) + fmt.Sprintf(format, a...))
+		pos := caller()
+		fields := []logger.Field{logger.F("id", c.id.String()), logger.F("caller", pos)}
+		output(c.logger, logger.LogLevelDebug, fmt.Sprintf("%s %s ", c.id.String(), pos), fields, fmt.Sprintf(format, a...))
 	}
 }
 func (c *connTcp) logInfof(format string, a ...interface{}) {
-	if c.logger != nil && c.logLevel >= logger.LogLevelInfo {
-		c.logger.Info(fmt.Sprintf("%s ", c.id.String()) + fmt.Sprintf(format, a...))
-	}
+	c.log(logger.LogLevelInfo, format, a...)
 }
 func (c *connTcp) logWarnf(format string, a ...interface{}) {
-	if c.logger != nil && c.logLevel >= logger.LogLevelWarn {
-		c.logger.Warn(fmt.Sprintf("%s ", c.id.String()) + fmt.Sprintf(format, a...))
-	}
+	c.log(logger.LogLevelWarn, format, a...)
 }
 func (c *connTcp) logErrorf(format string, a ...interface{}) {
-	if c.logger != nil && c.logLevel >= logger.LogLevelError {
-		c.logger.Error(fmt.Sprintf("%s ", c.id.String()) + fmt.Sprintf(format, a...))
+	c.log(logger.LogLevelError, format, a...)
+}
+
+func (c *connUdp) log(level logger.LogLevel, format string, a ...interface{}) {
+	if c.logger != nil && c.logLevel >= level {
+		output(c.logger, level, c.id.String()+" ", []logger.Field{logger.F("id", c.id.String())}, fmt.Sprintf(format, a...))
 	}
 }
+func (c *connUdp) logDebugf(format string, a ...interface{}) {
+	if c.logger != nil && c.logLevel >= logger.LogLevelDebug {
+		pos := caller()
+		fields := []logger.Field{logger.F("id", c.id.String()), logger.F("caller", pos)}
+		output(c.logger, logger.LogLevelDebug, fmt.Sprintf("%s %s ", c.id.String(), pos), fields, fmt.Sprintf(format, a...))
+	}
+}
+func (c *connUdp) logInfof(format string, a ...interface{}) {
+	c.log(logger.LogLevelInfo, format, a...)
+}
+func (c *connUdp) logWarnf(format string, a ...interface{}) {
+	c.log(logger.LogLevelWarn, format, a...)
+}
+func (c *connUdp) logErrorf(format string, a ...interface{}) {
+	c.log(logger.LogLevelError, format, a...)
+}
+
+func (s *MuxSession) log(level logger.LogLevel, format string, a ...interface{}) {
+	if s.logger != nil && s.logLevel >= level {
+		output(s.logger, level, "M "+s.id.String()+" ", []logger.Field{logger.F("id", s.id.String())}, fmt.Sprintf(format, a...))
+	}
+}
+func (s *MuxSession) logDebugf(format string, a ...interface{}) {
+	if s.logger != nil && s.logLevel >= logger.LogLevelDebug {
+		pos := caller()
+		fields := []logger.Field{logger.F("id", s.id.String()), logger.F("caller", pos)}
+		output(s.logger, logger.LogLevelDebug, fmt.Sprintf("M %s %s ", s.id.String(), pos), fields, fmt.Sprintf(format, a...))
+	}
+}
+func (s *MuxSession) logInfof(format string, a ...interface{}) {
+	s.log(logger.LogLevelInfo, format, a...)
+}
+func (s *MuxSession) logWarnf(format string, a ...interface{}) {
+	s.log(logger.LogLevelWarn, format, a...)
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const (
+	tunnelStateIdle   = "idle"
+	tunnelStateActive = "active"
+
+	failureAuth        = "auth"
+	failureUpgrade     = "upgrade"
+	failureUnsupported = "unsupported_protocol"
+	failureBadRequest  = "bad_request"
+	failureDial        = "dial"
+	failureQuota       = "quota"
+	failureLimit       = "limit"
+)
+
+// Metrics of a server, methods are no-op on nil
+type Metrics struct {
+	handler           http.Handler
+	tunnels           *prometheus.GaugeVec
+	handshakeFailures *prometheus.CounterVec
+	dialDuration      prometheus.Histogram
+	bytesSent         *prometheus.CounterVec
+	bytesReceived     *prometheus.CounterVec
+	idleWait          prometheus.Histogram
+	forceClosed       prometheus.Counter
+	tunnelsClosed     *prometheus.CounterVec
+}
+
+// NewMetrics makes metrics in a registry of their own, so that nothing else of the process is exposed
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		tunnels: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "weisuo_tunnels",
+			Help: "Number of tunnels, idle ones are waiting for requests.",
+		}, []string{"state"}),
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "weisuo_handshake_failures_total",
+			Help: "Number of failed requests by reason.",
+		}, []string{"reason"}),
+		dialDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "weisuo_target_dial_duration_seconds",
+			Help: "Duration of connecting targets, including resolving.",
+		}),
+		bytesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "weisuo_sent_bytes_total",
+			Help: "Bytes sent to clients by user.",
+		}, []string{"user"}),
+		bytesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "weisuo_received_bytes_total",
+			Help: "Bytes received from clients by user.",
+		}, []string{"user"}),
+		idleWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "weisuo_idle_wait_duration_seconds",
+			Help:    "Duration of idle connections waiting for requests.",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+		}),
+		forceClosed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "weisuo_tunnels_force_closed_total",
+			Help: "Number of tunnels closed forcibly at the drain deadline of shutdown.",
+		}),
+		tunnelsClosed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "weisuo_tunnels_closed_total",
+			Help: "Number of tunnels closed after carrying data by reason.",
+		}, []string{"reason"}),
+	}
+	r := prometheus.NewRegistry()
+	r.MustRegister(m.tunnels, m.handshakeFailures, m.dialDuration, m.bytesSent, m.bytesReceived,
+		m.idleWait, m.forceClosed, m.tunnelsClosed)
+	m.handler = promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+	return m
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+func (m *Metrics) addTunnel(state string, delta float64) {
+	if m != nil {
+		m.tunnels.WithLabelValues(state).Add(delta)
+	}
+}
+
+func (m *Metrics) handshakeFailure(reason string) {
+	if m != nil {
+		m.handshakeFailures.WithLabelValues(reason).Inc()
+	}
+}
+
+func (m *Metrics) observeDial(d time.Duration) {
+	if m != nil {
+		m.dialDuration.Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) observeIdleWait(d time.Duration) {
+	if m != nil {
+		m.idleWait.Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) addBytes(user string, sent, received int64) {
+	if m != nil {
+		m.bytesSent.WithLabelValues(user).Add(float64(sent))
+		m.bytesReceived.WithLabelValues(user).Add(float64(received))
+	}
+}
+
+func (m *Metrics) addForceClosed(n int) {
+	if m != nil {
+		m.forceClosed.Add(float64(n))
+	}
+}
+
+func (m *Metrics) tunnelClosed(reason string) {
+	if m != nil {
+		m.tunnelsClosed.WithLabelValues(reason).Inc()
+	}
+}
@@ -0,0 +1,706 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"weisuo/logger"
+)
+
+// Frames of a mux session, each frame is a binary WebSocket message:
+// 1 byte frame type, 4 bytes stream id (big endian), and the payload.
+const (
+	muxFrameOpen   = byte(1) // payload: json of reqMessage
+	muxFrameOpenOk = byte(2) // payload: empty
+	muxFrameData   = byte(3) // payload: data
+	muxFrameWindow = byte(4) // payload: 4 bytes window increment (big endian)
+	muxFrameFin    = byte(5) // payload: empty, the sender closes writing
+	muxFrameReset  = byte(6) // payload: 2 bytes error code (big endian) and error message, the stream is aborted
+
+	muxHeaderSize    = 5
+	muxMaxPayload    = 32 * 1024
+	muxInitialWindow = 256 * 1024
+)
+
+var (
+	ErrMuxSessionClosed = errors.New("mux session closed")
+	errPongTimeout      = errors.New("pong timeout")
+)
+
+// StreamError is reported when the peer resets a stream
+type StreamError struct {
+	Stream  uint32
+	Code    int
+	Message string
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stream %d reset: %s", e.Stream, e.Message)
+}
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return os.ErrDeadlineExceeded.Error() }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+func (e timeoutError) Unwrap() error   { return os.ErrDeadlineExceeded }
+
+// MuxSession carries many streams over a single WebSocket connection
+type MuxSession struct {
+	id         xid.ID
+	ws         *websocket.Conn
+	client     bool
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	streams  map[uint32]*muxStream
+	nextId   uint32
+	closed   bool
+	closeErr error
+	draining bool
+	// pong is nil on server, which sends no pings
+	pong *pongTracker
+
+	// accept is called in a new goroutine when the peer opens a stream
+	accept   func(st *muxStream, msg *reqMessage)
+	acceptWg sync.WaitGroup
+
+	logger    logger.Logger
+	logLevel  logger.LogLevel
+	logTarget LogTargetFunc
+}
+
+func newMuxSession(id xid.ID, ws *websocket.Conn, client bool, l logger.Logger, level logger.LogLevel, logTarget LogTargetFunc) *MuxSession {
+	s := &MuxSession{
+		id:        id,
+		ws:        ws,
+		client:    client,
+		streams:   make(map[uint32]*muxStream),
+		logger:    l,
+		logLevel:  level,
+		logTarget: logTarget,
+	}
+	if client {
+		s.nextId = 1
+	} else {
+		s.nextId = 2
+	}
+	return s
+}
+
+func (s *MuxSession) Id() string {
+	return s.id.String()
+}
+
+func (s *MuxSession) IsClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+// RTT returns the round-trip time measured by pings, or zero if not measured yet
+func (s *MuxSession) RTT() time.Duration {
+	return s.pong.lastRTT()
+}
+
+func (s *MuxSession) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+// Drain stops opening new streams, the session is closed once all streams are finished
+func (s *MuxSession) Drain() {
+	s.mutex.Lock()
+	s.draining = true
+	empty := len(s.streams) == 0
+	s.mutex.Unlock()
+
+	s.logDebugf("draining")
+	if empty {
+		go s.Close()
+	}
+}
+
+func (s *MuxSession) Close() error {
+	s.logDebugf("close")
+	if !s.shutdown(ErrMuxSessionClosed) {
+		return errors.New("already closed")
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_ = s.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "ok"),
+		time.Now().Add(time.Second),
+	)
+	return s.ws.Close()
+}
+
+// shutdown marks the session closed and aborts all streams, returns false if it's already closed
+func (s *MuxSession) shutdown(err error) bool {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return false
+	}
+	s.closed = true
+	s.closeErr = err
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mutex.Unlock()
+
+	for _, st := range streams {
+		st.abort(err)
+	}
+	return true
+}
+
+// Dial opens a new stream, only tcp is supported
+func (s *MuxSession) Dial(proto, target string) (TCPConn, error) {
+	return s.DialContext(context.Background(), proto, target)
+}
+
+// DialContext opens a new stream, which is reset if ctx is done before it's opened
+func (s *MuxSession) DialContext(ctx context.Context, proto, target string) (TCPConn, error) {
+	if proto != ProtocolTCP {
+		return nil, fmt.Errorf("unsupported protocol over mux: %s", proto)
+	}
+
+	s.mutex.Lock()
+	if s.closed || s.draining {
+		s.mutex.Unlock()
+		return nil, ErrMuxSessionClosed
+	}
+	openCh := make(chan error, 1)
+	st := newMuxStream(s, s.nextId)
+	st.openCh = openCh
+	s.nextId += 2
+	s.streams[st.id] = st
+	s.mutex.Unlock()
+
+	payload, err := json.Marshal(&reqMessage{
+		Protocol: proto,
+		Target:   target,
+	})
+	if err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	err = s.writeFrame(muxFrameOpen, st.id, payload)
+	if err != nil {
+		s.removeStream(st.id)
+		return nil, fmt.Errorf("send req failure: %v", err)
+	}
+
+	select {
+	case err = <-openCh:
+	case <-ctx.Done():
+		st.reset(ErrorCodeFailure, "canceled")
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		s.removeStream(st.id)
+		return nil, fmt.Errorf("cannot open: %w", err)
+	}
+
+	s.logInfof("stream %d connected %s", st.id, logTarget(s.logTarget, target))
+	return st, nil
+}
+
+func (s *MuxSession) removeStream(id uint32) {
+	s.mutex.Lock()
+	delete(s.streams, id)
+	drained := s.draining && !s.closed && len(s.streams) == 0
+	s.mutex.Unlock()
+
+	if drained {
+		go s.Close()
+	}
+}
+
+func (s *MuxSession) getStream(id uint32) *muxStream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[id]
+}
+
+func (s *MuxSession) writeFrame(t byte, id uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderSize+len(payload))
+	buf[0] = t
+	binary.BigEndian.PutUint32(buf[1:muxHeaderSize], id)
+	copy(buf[muxHeaderSize:], payload)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	err := s.ws.WriteMessage(websocket.BinaryMessage, buf)
+	if err != nil {
+		go s.shutdown(fmt.Errorf("mux write failure: %v", err))
+	}
+	return err
+}
+
+func (s *MuxSession) writeReset(id uint32, code int, message string) {
+	payload := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], message)
+	err := s.writeFrame(muxFrameReset, id, payload)
+	if err != nil {
+		s.logDebugf("stream %d send reset failure: %v", id, err)
+	}
+}
+
+// readLoop dispatches frames until the WebSocket connection fails
+func (s *MuxSession) readLoop() {
+	for {
+		mt, buf, err := s.ws.ReadMessage()
+		if err != nil {
+			s.logDebugf("read loop end: %v", err)
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				err = ErrMuxSessionClosed
+			}
+			s.shutdown(err)
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		if len(buf) < muxHeaderSize {
+			s.logWarnf("invalid frame of %d bytes", len(buf))
+			continue
+		}
+
+		t := buf[0]
+		id := binary.BigEndian.Uint32(buf[1:muxHeaderSize])
+		payload := buf[muxHeaderSize:]
+
+		if t == muxFrameOpen {
+			s.handleOpen(id, payload)
+			continue
+		}
+
+		st := s.getStream(id)
+		if st == nil {
+			if t != muxFrameReset && t != muxFrameWindow {
+				s.logDebugf("stream %d unknown, frame %d", id, t)
+				s.writeReset(id, ErrorCodeFailure, "unknown stream")
+			}
+			continue
+		}
+
+		switch t {
+		case muxFrameOpenOk:
+			st.opened(nil)
+		case muxFrameData:
+			if !st.pushData(payload) {
+				s.logWarnf("stream %d exceeds window", id)
+				st.reset(ErrorCodeFailure, "flow control violation")
+			}
+		case muxFrameWindow:
+			if len(payload) == 4 {
+				st.addSendWindow(int(binary.BigEndian.Uint32(payload)))
+			}
+		case muxFrameFin:
+			st.remoteFin()
+		case muxFrameReset:
+			streamErr := &StreamError{Stream: id, Code: ErrorCodeFailure}
+			if len(payload) >= 2 {
+				streamErr.Code = validErrorCode(int(binary.BigEndian.Uint16(payload)))
+				streamErr.Message = string(payload[2:])
+			}
+			if !st.opened(streamErr) {
+				st.abort(streamErr)
+			}
+			s.removeStream(id)
+		default:
+			s.logDebugf("stream %d unknown frame %d", id, t)
+		}
+	}
+}
+
+func (s *MuxSession) handleOpen(id uint32, payload []byte) {
+	if s.client || s.accept == nil {
+		s.writeReset(id, ErrorCodeFailure, "unexpected open")
+		return
+	}
+
+	var msg reqMessage
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		s.writeReset(id, ErrorCodeFailure, "cannot read request")
+		return
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	if s.draining {
+		s.mutex.Unlock()
+		s.writeReset(id, ErrorCodeFailure, "session draining")
+		return
+	}
+	if _, ok := s.streams[id]; ok {
+		s.mutex.Unlock()
+		s.writeReset(id, ErrorCodeFailure, "duplicated stream")
+		return
+	}
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mutex.Unlock()
+
+	s.acceptWg.Add(1)
+	go func() {
+		defer s.acceptWg.Done()
+		s.accept(st, &msg)
+	}()
+}
+
+func (s *MuxSession) pinger(hb Heartbeat) {
+	err := hb.run(s.IsClosed, s.ping, s.keepalive)
+	if errors.Is(err, errPongTimeout) {
+		s.logWarnf("pong timeout, %d pings missed", s.pong.missed())
+		s.shutdown(errPongTimeout)
+		_ = s.ws.Close()
+		return
+	}
+	if err != nil {
+		s.logDebugf("ping err, stop: %v", err)
+		s.shutdown(fmt.Errorf("ping failure: %v", err))
+		return
+	}
+	s.logDebugf("ping stopped")
+}
+
+func (s *MuxSession) ping() error {
+	payload, ok := s.pong.next()
+	if !ok {
+		return errPongTimeout
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return s.ws.WriteMessage(websocket.PingMessage, payload)
+}
+
+// keepalive sends a keepalive message, which is skipped by the read loop of the server as a text message
+func (s *MuxSession) keepalive() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return s.ws.WriteMessage(websocket.TextMessage, []byte(keepaliveMessage))
+}
+
+// muxStream is a logical tcp stream in a mux session
+type muxStream struct {
+	s  *MuxSession
+	id uint32
+
+	mutex       sync.Mutex
+	cond        *sync.Cond
+	openCh      chan error
+	readBuf     []byte
+	recvWindow  int
+	consumed    int
+	sendWindow  int
+	readClosed  bool
+	writeClosed bool
+	closed      bool
+	err         error
+	onAbort     func()
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newMuxStream(s *MuxSession, id uint32) *muxStream {
+	st := &muxStream{
+		s:          s,
+		id:         id,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+	}
+	st.cond = sync.NewCond(&st.mutex)
+	return st
+}
+
+// opened delivers the result of opening, returns false if the stream was not being opened
+func (st *muxStream) opened(err error) bool {
+	st.mutex.Lock()
+	ch := st.openCh
+	st.openCh = nil
+	st.mutex.Unlock()
+
+	if ch == nil {
+		return false
+	}
+	ch <- err
+	return true
+}
+
+func (st *muxStream) pushData(data []byte) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if len(data) > st.recvWindow {
+		return false
+	}
+	if st.readClosed || st.closed {
+		// nobody would read it, but window is still consumed
+		return true
+	}
+	st.recvWindow -= len(data)
+	st.readBuf = append(st.readBuf, data...)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *muxStream) addSendWindow(n int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+func (st *muxStream) remoteFin() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.readClosed = true
+	st.cond.Broadcast()
+	st.checkDone()
+}
+
+// reset aborts the stream and notifies the peer
+func (st *muxStream) reset(code int, message string) {
+	st.abort(&StreamError{Stream: st.id, Code: code, Message: message})
+	st.s.removeStream(st.id)
+	st.s.writeReset(st.id, code, message)
+}
+
+func (st *muxStream) abort(err error) {
+	st.opened(err)
+
+	st.mutex.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	onAbort := st.onAbort
+	st.onAbort = nil
+	st.mutex.Unlock()
+
+	if onAbort != nil {
+		onAbort()
+	}
+}
+
+// setOnAbort registers a callback called once the stream is aborted
+func (st *muxStream) setOnAbort(cb func()) {
+	st.mutex.Lock()
+	aborted := st.err != nil
+	if !aborted {
+		st.onAbort = cb
+	}
+	st.mutex.Unlock()
+
+	if aborted {
+		cb()
+	}
+}
+
+// checkDone removes the stream after both directions are finished, st.mutex must be held
+func (st *muxStream) checkDone() {
+	if st.readClosed && st.writeClosed {
+		go st.s.removeStream(st.id)
+	}
+}
+
+func (st *muxStream) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, errors.New("buffer size is 0")
+	}
+
+	st.mutex.Lock()
+	for len(st.readBuf) == 0 {
+		if st.closed {
+			st.mutex.Unlock()
+			return 0, errors.New("read already closed")
+		}
+		if st.err != nil {
+			st.mutex.Unlock()
+			return 0, st.err
+		}
+		if st.readClosed {
+			st.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if !st.readDeadline.IsZero() && !time.Now().Before(st.readDeadline) {
+			st.mutex.Unlock()
+			return 0, timeoutError{}
+		}
+		st.cond.Wait()
+	}
+
+	n := copy(buf, st.readBuf)
+	st.readBuf = st.readBuf[n:]
+	if len(st.readBuf) == 0 {
+		st.readBuf = nil
+	}
+	st.consumed += n
+	increment := 0
+	if st.consumed >= muxInitialWindow/2 && !st.readClosed {
+		increment = st.consumed
+		st.recvWindow += increment
+		st.consumed = 0
+	}
+	st.mutex.Unlock()
+
+	if increment > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(increment))
+		_ = st.s.writeFrame(muxFrameWindow, st.id, payload)
+	}
+
+	return n, nil
+}
+
+func (st *muxStream) Write(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, errors.New("empty data")
+	}
+
+	written := 0
+	for written < len(buf) {
+		st.mutex.Lock()
+		for {
+			if st.writeClosed || st.closed {
+				st.mutex.Unlock()
+				return written, errors.New("write already closed")
+			}
+			if st.err != nil {
+				st.mutex.Unlock()
+				return written, st.err
+			}
+			if !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline) {
+				st.mutex.Unlock()
+				return written, timeoutError{}
+			}
+			if st.sendWindow > 0 {
+				break
+			}
+			st.cond.Wait()
+		}
+
+		n := len(buf) - written
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+		st.sendWindow -= n
+		st.mutex.Unlock()
+
+		err := st.s.writeFrame(muxFrameData, st.id, buf[written:written+n])
+		if err != nil {
+			return written, fmt.Errorf("write err: %v", err)
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+func (st *muxStream) CloseWrite() error {
+	st.mutex.Lock()
+	if st.writeClosed || st.closed {
+		st.mutex.Unlock()
+		return errors.New("write already closed")
+	}
+	st.writeClosed = true
+	st.checkDone()
+	st.mutex.Unlock()
+
+	return st.s.writeFrame(muxFrameFin, st.id, nil)
+}
+
+func (st *muxStream) Close() error {
+	st.mutex.Lock()
+	if st.closed {
+		st.mutex.Unlock()
+		return errors.New("conn already closed")
+	}
+	st.closed = true
+	finished := st.readClosed && st.writeClosed
+	aborted := st.err != nil
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+
+	st.s.removeStream(st.id)
+	if finished || aborted {
+		return nil
+	}
+	st.s.writeReset(st.id, ErrorCodeFailure, "closed")
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.s.ws.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.s.ws.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	err := st.SetWriteDeadline(t)
+	if err != nil {
+		return err
+	}
+	return st.SetReadDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.readDeadline = t
+	st.readTimer = st.resetTimer(st.readTimer, t)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.writeDeadline = t
+	st.writeTimer = st.resetTimer(st.writeTimer, t)
+	return nil
+}
+
+// resetTimer wakes up blocked Read or Write at deadline, st.mutex must be held
+func (st *muxStream) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	st.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		st.mutex.Lock()
+		defer st.mutex.Unlock()
+		st.cond.Broadcast()
+	})
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+// RTTFunc is called with each round-trip time measured by pings
+type RTTFunc func(rtt time.Duration)
+
+// RTTConn is implemented by connections of clients, which measure round-trip times by pings
+type RTTConn interface {
+	// RTT returns the last measured round-trip time, or zero if not measured yet
+	RTT() time.Duration
+}
+
+// pongTracker tracks pongs of pings sent on a WebSocket connection, to detect dead connections and measure RTT.
+// Pongs are handled only while the connection is being read, so misses are counted only then.
+type pongTracker struct {
+	maxMisses  int
+	observeRTT RTTFunc
+
+	mutex   sync.Mutex
+	waiting bool
+	misses  int
+	rtt     time.Duration
+	// notReading is set while nothing reads the connection, it's never set for connections read all the time
+	notReading bool
+}
+
+// newPongTracker installs the pong handler of ws, zero maxMisses means never giving up
+func newPongTracker(ws *websocket.Conn, maxMisses int, observeRTT RTTFunc) *pongTracker {
+	p := &pongTracker{
+		maxMisses:  maxMisses,
+		observeRTT: observeRTT,
+	}
+	ws.SetPongHandler(p.pong)
+	return p
+}
+
+// next returns the payload of the next ping, which is the time of sending,
+// or false if pongs of too many pings in a row are missed
+func (p *pongTracker) next() ([]byte, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.waiting && !p.notReading {
+		p.misses++
+	}
+	if p.maxMisses > 0 && p.misses >= p.maxMisses {
+		return nil, false
+	}
+	p.waiting = true
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	return payload, true
+}
+
+func (p *pongTracker) pong(data string) error {
+	if len(data) != 8 {
+		return nil
+	}
+	rtt := time.Duration(time.Now().UnixNano() - int64(binary.BigEndian.Uint64([]byte(data))))
+	if rtt < 0 {
+		return nil
+	}
+
+	p.mutex.Lock()
+	p.waiting = false
+	p.misses = 0
+	p.rtt = rtt
+	p.mutex.Unlock()
+
+	if p.observeRTT != nil {
+		p.observeRTT(rtt)
+	}
+	return nil
+}
+
+// setReading marks whether the connection is being read
+func (p *pongTracker) setReading(reading bool) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.notReading = !reading
+}
+
+func (p *pongTracker) missed() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.misses
+}
+
+// lastRTT returns the last measured round-trip time, or zero if not measured yet
+func (p *pongTracker) lastRTT() time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.rtt
+}
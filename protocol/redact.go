@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// LogTargetFunc returns the target as it is shown in logs, e.g. hashed for privacy
+type LogTargetFunc func(target string) string
+
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are masked in logs
+var sensitiveHeaders = []string{
+	HeaderKeyAuth,
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// redactHeader returns a copy of the header, values of sensitive headers are masked
+func redactHeader(header http.Header) http.Header {
+	h := header.Clone()
+	for _, k := range sensitiveHeaders {
+		k = http.CanonicalHeaderKey(k)
+		if _, ok := h[k]; ok {
+			h[k] = []string{redacted}
+		}
+	}
+	return h
+}
+
+// redactSecret masks a non-empty secret
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// HashTargetHost returns a LogTargetFunc, which replaces the host of the target with its HMAC-SHA256 by key.
+// The port is kept. The same host is always logged the same with the same key.
+func HashTargetHost(key []byte) LogTargetFunc {
+	return func(target string) string {
+		host, port := splitTarget(target)
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(host))
+		return joinTarget(hex.EncodeToString(mac.Sum(nil)[:8]), port)
+	}
+}
+
+// OmitTargetHost replaces the host of the target with `*`, the port is kept
+func OmitTargetHost(target string) string {
+	_, port := splitTarget(target)
+	return joinTarget("*", port)
+}
+
+func splitTarget(target string) (string, string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target, ""
+	}
+	return host, port
+}
+
+func joinTarget(host, port string) string {
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+// HideTargetHost replaces the host of the target in s, as it's transformed by f
+func HideTargetHost(f LogTargetFunc, s, target string) string {
+	if f == nil {
+		return s
+	}
+	host, _ := splitTarget(target)
+	if host == "" {
+		return s
+	}
+	hidden, _ := splitTarget(f(target))
+	return strings.ReplaceAll(s, host, hidden)
+}
+
+// logTarget returns the target as it is shown in logs
+func logTarget(f LogTargetFunc, target string) string {
+	if f == nil || target == "" {
+		return target
+	}
+	return f(target)
+}
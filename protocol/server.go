@@ -1,22 +1,49 @@
 package protocol
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"weisuo/logger"
+	"weisuo/ratelimit"
 	"weisuo/serverhelper"
 )
 
-type AuthenticatorFunc func(remoteIp, auth string) bool
-type TargetFilterFunc func(remoteIp, target string) bool
+// AuthenticatorFunc returns the user identity and whether the request is authorized,
+// the identity may be empty if there are no multiple users
+type AuthenticatorFunc func(remoteIp, auth, target string) (string, bool)
+
+// TargetFilterFunc is called with each resolved ip address of the target host,
+// the target is connected only through allowed addresses
+type TargetFilterFunc func(user, host string, ip net.IP, port int) bool
 type RealIpFunc func(r *http.Request) string
 
+// AccountingFunc is called with bytes transferred for the user, which are accumulated for each request,
+// and flushed every accountingInterval and when the request ends
+type AccountingFunc func(user string, sent, received int64)
+
+const accountingInterval = time.Second
+
+// QuotaFunc returns false if the user has run out of quota
+type QuotaFunc func(user string) bool
+
+// RateLimitFunc returns limiters of a new tunnel of the user, for upload and download
+type RateLimitFunc func(user string) (upload []*ratelimit.Limiter, download []*ratelimit.Limiter)
+
+var (
+	ErrTargetNotAllowed = errors.New("target not allowed")
+)
+
 type Handler struct {
 	WebsocketUpgrader *websocket.Upgrader
 	Authenticator     AuthenticatorFunc
@@ -24,6 +51,28 @@ type Handler struct {
 	RealIpFunc        RealIpFunc
 	Logger            logger.Logger
 	LogLevel          logger.LogLevel
+	UDPIdleTimeout    time.Duration
+	Metrics           *Metrics
+	Tunnels           *Tunnels
+	// LogTarget transforms targets in logs, they are logged as they are if nil
+	LogTarget LogTargetFunc
+	// Fallback serves requests which fail auth or are not WebSocket requests, instead of errors
+	Fallback http.Handler
+	// Accounting counts traffic of users
+	Accounting AccountingFunc
+	// Quota is checked before each tunnel, tunnels of users out of quota are refused
+	Quota QuotaFunc
+	// RateLimit limits bandwidth of tunnels, they are unlimited if nil
+	RateLimit RateLimitFunc
+	// Limits caps concurrent handshakes, idle connections and tunnels
+	Limits *Limits
+	// IdleRequestTimeout closes idle connections without a request in time, zero means no timeout
+	IdleRequestTimeout time.Duration
+	// TunnelIdleTimeout closes tunnels and mux streams without data either way, and mux connections without streams
+	// for the duration, zero means no timeout
+	TunnelIdleTimeout time.Duration
+	// TunnelMaxLifetime closes tunnels and mux connections older than it, zero means unlimited
+	TunnelMaxLifetime time.Duration
 }
 
 func DefaultHandler() *Handler {
@@ -33,28 +82,166 @@ func DefaultHandler() *Handler {
 			ReadBufferSize:   16 * 1024,
 			WriteBufferSize:  16 * 1024,
 		},
-		RealIpFunc: serverhelper.DefaultRealIpFunc,
-		Logger:     &logger.DefaultLogger{},
-		LogLevel:   logger.LogLevelInfo,
+		RealIpFunc:     serverhelper.DefaultRealIpFunc,
+		Logger:         &logger.DefaultLogger{},
+		LogLevel:       logger.LogLevelInfo,
+		UDPIdleTimeout: 60 * time.Second,
 	}
 }
 
+// Shutdown drains tunnels of the handler until ctx is done, returns the number of tunnels closed forcibly
+func (h *Handler) Shutdown(ctx context.Context) int {
+	n := h.Tunnels.Drain(ctx)
+	h.Metrics.addForceClosed(n)
+	return n
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	req := &request{
-		w:  w,
-		r:  r,
-		h:  h,
-		id: xid.New(),
+		w:     w,
+		r:     r,
+		h:     h,
+		id:    xid.New(),
+		start: time.Now(),
+	}
+	if h.Accounting != nil {
+		stop := make(chan struct{})
+		go req.runAccounting(stop)
+		defer func() {
+			close(stop)
+			req.flushAccounting()
+		}()
 	}
 	req.handle()
 }
 
 type request struct {
+	// accessed atomically, bytes not flushed to Accounting yet
+	pendingSent     int64
+	pendingReceived int64
+
 	w      http.ResponseWriter
 	r      *http.Request
 	h      *Handler
 	id     xid.ID
 	realIp string
+	user   string
+	tunnel *tunnel
+	start  time.Time
+	proto  string
+	target string
+	// endHandshake is called once the handshake ends, to release the handshake slot
+	endHandshake func()
+	// reason is set if the request is closed by timeouts
+	reason closeReason
+}
+
+// setTarget is called once the target is known, before data is transferred
+func (req *request) setTarget(proto, target string) {
+	req.proto = proto
+	req.target = target
+	req.tunnel.setTarget(proto, target)
+}
+
+func (req *request) addSent(n int64) {
+	req.tunnel.addSent(n)
+	if req.h.Accounting != nil {
+		atomic.AddInt64(&req.pendingSent, n)
+	}
+}
+
+func (req *request) addReceived(n int64) {
+	req.tunnel.addReceived(n)
+	if req.h.Accounting != nil {
+		atomic.AddInt64(&req.pendingReceived, n)
+	}
+}
+
+// runAccounting flushes pending bytes periodically until stop is closed, so that idle tunnels are counted too
+func (req *request) runAccounting(stop chan struct{}) {
+	ticker := time.NewTicker(accountingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			req.flushAccounting()
+		}
+	}
+}
+
+// flushAccounting passes pending bytes to Accounting.
+// The user is read only if there are bytes, which are added after the user is set.
+func (req *request) flushAccounting() {
+	sent := atomic.SwapInt64(&req.pendingSent, 0)
+	received := atomic.SwapInt64(&req.pendingReceived, 0)
+	if sent != 0 || received != 0 {
+		req.h.Accounting(req.user, sent, received)
+	}
+}
+
+func (req *request) rateLimiters() ([]*ratelimit.Limiter, []*ratelimit.Limiter) {
+	if req.h.RateLimit == nil {
+		return nil, nil
+	}
+	return req.h.RateLimit(req.user)
+}
+
+// closeReason returns the reason of closing a tunnel or stream, which is either closed by itself,
+// or with the whole request
+func (req *request) closeReason(reason string) string {
+	if reason == "" {
+		reason = req.reason.get()
+	}
+	if reason == "" {
+		reason = req.tunnel.closeReason()
+	}
+	if reason == "" {
+		reason = closeReasonNormal
+	}
+	return reason
+}
+
+// limitExceeded records the request rejected by limits
+func (req *request) limitExceeded(err error, fields ...logger.Field) {
+	req.h.Metrics.handshakeFailure(failureLimit)
+	req.with(fields...).logWarnf("rejected, %v", err)
+}
+
+// rejectLimit responds the request rejected by limits
+func (req *request) rejectLimit(err error) {
+	req.limitExceeded(err)
+	req.w.Header().Set(HeaderKeyError, strconv.Itoa(ErrorCodeLimitExceeded))
+	http.Error(req.w, "Limit exceeded", http.StatusServiceUnavailable)
+}
+
+// rejectHandshake responds the request rejected by max handshakes, which is not authorized yet,
+// so it's served by the fallback or closed, telling nothing about the server
+func (req *request) rejectHandshake(err error) {
+	req.limitExceeded(err)
+	if req.h.Fallback != nil {
+		req.h.Fallback.ServeHTTP(req.w, req.r)
+		return
+	}
+	if hijacker, ok := req.w.(http.Hijacker); ok {
+		conn, _, err := hijacker.Hijack()
+		if err == nil {
+			conn.Close()
+			return
+		}
+	}
+	http.Error(req.w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// quotaExceeded returns whether the user has run out of quota
+func (req *request) quotaExceeded() bool {
+	if req.h.Quota == nil || req.h.Quota(req.user) {
+		return false
+	}
+	req.h.Metrics.handshakeFailure(failureQuota)
+	req.logWarnf("quota exceeded")
+	return true
 }
 
 func (req *request) handle() {
@@ -63,12 +250,56 @@ func (req *request) handle() {
 	proto := req.r.Header.Get(HeaderKeyProtocol)
 	target := req.r.Header.Get(HeaderKeyTarget)
 
-	req.logDebugf("headers %v", req.r.Header)
-	req.logDebugf("auth [%s] proto [%s] target [%s]", auth, proto, target)
+	req.logDebugf("headers %v", req.logHeader())
+	req.logDebugf("auth [%s] proto [%s] target [%s]", redactSecret(auth), proto, req.logTarget(target))
+
+	if req.h.Fallback != nil && !websocket.IsWebSocketUpgrade(req.r) {
+		req.logDebugf("not a websocket request, fallback")
+		req.h.Fallback.ServeHTTP(req.w, req.r)
+		return
+	}
 
-	if req.h.Authenticator != nil && !req.h.Authenticator(req.realIp, auth) {
-		http.Error(req.w, "Invalid credentials", http.StatusUnauthorized)
-		req.logWarnf("unauthorized %s", auth)
+	endHandshake, err := req.h.Limits.startHandshake()
+	if err != nil {
+		req.rejectHandshake(err)
+		return
+	}
+	req.endHandshake = endHandshake
+	defer endHandshake()
+
+	if req.h.Authenticator != nil {
+		user, ok := req.h.Authenticator(req.realIp, auth, target)
+		if !ok {
+			req.h.Metrics.handshakeFailure(failureAuth)
+			if req.h.Fallback != nil {
+				req.logWarnf("unauthorized, fallback")
+				req.h.Fallback.ServeHTTP(req.w, req.r)
+				return
+			}
+			http.Error(req.w, "Invalid credentials", http.StatusUnauthorized)
+			req.logWarnf("unauthorized")
+			return
+		}
+		req.user = user
+	}
+
+	if req.quotaExceeded() {
+		req.w.Header().Set(HeaderKeyError, strconv.Itoa(ErrorCodeQuotaExceeded))
+		http.Error(req.w, "Quota exceeded", http.StatusForbidden)
+		return
+	}
+
+	var ok bool
+	req.tunnel, ok = req.h.Tunnels.add(req)
+	if !ok {
+		http.Error(req.w, "Server shutting down", http.StatusServiceUnavailable)
+		req.logInfof("rejected, server shutting down")
+		return
+	}
+	defer req.h.Tunnels.remove(req.tunnel)
+
+	if proto == ProtocolMux && target == "" {
+		req.handleMuxConn()
 		return
 	}
 
@@ -83,55 +314,136 @@ func (req *request) handle() {
 func (req *request) handleIdleConn() {
 	req.logDebugf("idle conn")
 
+	removeIdle, err := req.h.Limits.addIdle(req.user, req.realIp)
+	if err != nil {
+		req.rejectLimit(err)
+		return
+	}
+	removed := false
+	defer func() {
+		if !removed {
+			removeIdle()
+		}
+	}()
+
 	respHeader := make(http.Header)
 	respHeader.Set(HeaderKeyId, req.id.String())
 	wsConn, err := req.h.WebsocketUpgrader.Upgrade(req.w, req.r, respHeader)
 	if err != nil {
-		req.logErrorf("websocket upgrade failure: %v", err)
+		req.h.Metrics.handshakeFailure(failureUpgrade)
+		req.with(logger.F("error", err)).logErrorf("websocket upgrade failure: %v", err)
 		return
 	}
 	defer func() {
 		err = wsConn.Close()
 		req.logDebugf("close of ws underlying conn: %v", err)
 	}()
+	req.tunnel.addCloser(wsConn)
 	req.logDebugf("ws upgraded")
 
+	drain := func() {
+		_ = wsConn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(time.Second),
+		)
+		_ = wsConn.SetReadDeadline(time.Now().Add(time.Second))
+	}
+	if !req.tunnel.setDrainFunc(drain) {
+		drain()
+	}
+	req.endHandshake()
+
+	idleStart := time.Now()
+	req.h.Metrics.addTunnel(tunnelStateIdle, 1)
+	if req.h.IdleRequestTimeout > 0 {
+		_ = wsConn.SetReadDeadline(idleStart.Add(req.h.IdleRequestTimeout))
+	}
 	var reqMsg reqMessage
-	err = wsConn.ReadJSON(&reqMsg)
+	err = readRequest(wsConn, &reqMsg)
+	req.h.Metrics.addTunnel(tunnelStateIdle, -1)
+	req.h.Metrics.observeIdleWait(time.Since(idleStart))
+	removeIdle()
+	removed = true
+	if !req.tunnel.setDrainFunc(nil) {
+		req.logInfof("closed by draining")
+		return
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// the request is not handled, so that the client uses another connection
+		wsConn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle request timeout"),
+			time.Now().Add(time.Second),
+		)
+		req.logInfof("closed by idle request timeout")
+		return
+	}
+	_ = wsConn.SetReadDeadline(time.Time{})
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		// closed without a request, like health checks and idle connections evicted by pools
+		req.logDebugf("closed by client while idle")
+		return
+	}
 	if err != nil {
+		req.h.Metrics.handshakeFailure(failureBadRequest)
 		wsConn.WriteControl(
 			websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseAbnormalClosure, "cannot read request"),
 			time.Now().Add(time.Second),
 		)
-		req.logWarnf("cannot read request %v", err)
+		req.with(logger.F("error", err)).logWarnf("cannot read request %v", err)
 		return
 	}
 
-	if reqMsg.Protocol != "tcp" {
+	if !isSupportedProtocol(reqMsg.Protocol) {
 		wsConn.WriteControl(
 			websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseAbnormalClosure, "unsupported protocol"),
+			websocket.FormatCloseMessage(ErrorCodeUnsupported, "unsupported protocol"),
 			time.Now().Add(time.Second),
 		)
+		req.h.Metrics.handshakeFailure(failureUnsupported)
 		req.logWarnf("unsupported protocol %s", reqMsg.Protocol)
 		return
 	}
 
-	req.logInfof("connect %s", reqMsg.Target)
-	rawConn, err := net.DialTimeout("tcp", reqMsg.Target, time.Second*10)
+	if req.quotaExceeded() {
+		wsConn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(ErrorCodeQuotaExceeded, "quota exceeded"),
+			time.Now().Add(time.Second),
+		)
+		return
+	}
+
+	req.setTarget(reqMsg.Protocol, reqMsg.Target)
+	removeTunnel, err := req.h.Limits.addTunnel(req.user, reqMsg.Target)
+	if err != nil {
+		wsConn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(ErrorCodeLimitExceeded, err.Error()),
+			time.Now().Add(time.Second),
+		)
+		req.limitExceeded(err)
+		return
+	}
+	defer removeTunnel()
+	req.logInfof("connect %s %s", reqMsg.Protocol, req.logTarget(reqMsg.Target))
+	remoteConn, err := req.dialTarget(reqMsg.Protocol, reqMsg.Target)
 	if err != nil {
 		wsConn.WriteControl(
 			websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, fmt.Sprintf("Connection failure: %v", err)),
+			websocket.FormatCloseMessage(dialErrorCode(err), fmt.Sprintf("Connection failure: %v", err)),
 			time.Now().Add(time.Second),
 		)
-		req.logErrorf("connection failure: %v", err)
+		logErr := req.logError(err, req.target)
+		req.with(logger.F("error", logErr)).logErrorf("connection failure: %v", logErr)
 		return
 	}
 	req.logDebugf("connected")
-	remoteConn := TCPConn(rawConn.(*net.TCPConn))
 	defer remoteConn.Close()
+	req.tunnel.addCloser(remoteConn)
 
 	err = wsConn.WriteMessage(websocket.TextMessage, []byte("ok"))
 	if err != nil {
@@ -140,45 +452,264 @@ func (req *request) handleIdleConn() {
 			websocket.FormatCloseMessage(websocket.CloseAbnormalClosure, fmt.Sprintf("Response failure: %v", err)),
 			time.Now().Add(time.Second),
 		)
-		req.logErrorf("response failure: %v", err)
+		req.with(logger.F("error", err)).logErrorf("response failure: %v", err)
 		return
 	}
 
-	req.handleNetwork(wsConn, remoteConn)
+	req.serve(wsConn, remoteConn)
+}
+
+// readRequest reads the request message of an idle connection, keepalive messages are skipped
+func readRequest(ws *websocket.Conn, msg *reqMessage) error {
+	for {
+		mt, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if !isKeepalive(mt, data) {
+			return json.Unmarshal(data, msg)
+		}
+	}
 }
 
 func (req *request) handleDirectConn(proto, target string) {
-	if proto != "tcp" {
+	if !isSupportedProtocol(proto) {
+		req.w.Header().Set(HeaderKeyError, strconv.Itoa(ErrorCodeUnsupported))
 		http.Error(req.w, "Unsupported protocol", http.StatusBadRequest)
+		req.h.Metrics.handshakeFailure(failureUnsupported)
 		req.logWarnf("unsupported protocol %s", proto)
 		return
 	}
 
-	req.logInfof("connect %s", target)
-	rawConn, err := net.DialTimeout("tcp", target, time.Second*10)
+	req.setTarget(proto, target)
+	removeTunnel, err := req.h.Limits.addTunnel(req.user, target)
+	if err != nil {
+		req.rejectLimit(err)
+		return
+	}
+	defer removeTunnel()
+	req.logInfof("connect %s %s", proto, req.logTarget(target))
+	remoteConn, err := req.dialTarget(proto, target)
 	if err != nil {
-		http.Error(req.w, fmt.Sprintf("Connection failure: %v", err), http.StatusBadGateway)
-		req.logErrorf("connection failure: %v", err)
+		code := dialErrorCode(err)
+		req.w.Header().Set(HeaderKeyError, strconv.Itoa(code))
+		http.Error(req.w, fmt.Sprintf("Connection failure: %v", err), errorCodeStatus(code))
+		logErr := req.logError(err, req.target)
+		req.with(logger.F("error", logErr)).logErrorf("connection failure: %v", logErr)
 		return
 	}
 	req.logDebugf("connected")
-	remoteConn := TCPConn(rawConn.(*net.TCPConn))
 	defer remoteConn.Close()
+	req.tunnel.addCloser(remoteConn)
 
 	respHeader := make(http.Header)
 	respHeader.Set(HeaderKeyId, req.id.String())
 	wsConn, err := req.h.WebsocketUpgrader.Upgrade(req.w, req.r, respHeader)
 	if err != nil {
-		req.logErrorf("websocket upgrade failure: %v", err)
+		req.h.Metrics.handshakeFailure(failureUpgrade)
+		req.with(logger.F("error", err)).logErrorf("websocket upgrade failure: %v", err)
 		return
 	}
 	defer func() {
 		err = wsConn.Close()
 		req.logDebugf("close of ws underlying conn: %v", err)
 	}()
+	req.tunnel.addCloser(wsConn)
 	req.logDebugf("ws upgraded")
 
-	req.handleNetwork(wsConn, remoteConn)
+	req.serve(wsConn, remoteConn)
+}
+
+func transferFields(sent, received int64, duration time.Duration, reason string) []logger.Field {
+	return []logger.Field{
+		logger.F("bytes_sent", sent),
+		logger.F("bytes_received", received),
+		logger.F("duration", duration),
+		logger.F("close_reason", reason),
+	}
+}
+
+func isSupportedProtocol(proto string) bool {
+	return proto == ProtocolTCP || proto == ProtocolUDP
+}
+
+func (req *request) dialTarget(proto, target string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := req.resolveAndDial(proto, target)
+	req.h.Metrics.observeDial(time.Since(start))
+	if err != nil {
+		req.h.Metrics.handshakeFailure(failureDial)
+	}
+	return conn, err
+}
+
+func (req *request) resolveAndDial(proto, target string) (net.Conn, error) {
+	if req.h.TargetFilter == nil {
+		return net.DialTimeout(proto, target, time.Second*10)
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort(proto, portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	// check resolved addresses and connect them directly, so that DNS rebinding does not work
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var allowed []net.IP
+	for _, addr := range addrs {
+		if req.h.TargetFilter(req.user, host, addr.IP, port) {
+			allowed = append(allowed, addr.IP)
+		} else {
+			req.logDebugf("target filtered: %s %s", req.logTarget(host), addr.IP)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, ErrTargetNotAllowed
+	}
+
+	var d net.Dialer
+	for _, ip := range allowed {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, proto, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (req *request) serve(wsConn *websocket.Conn, remoteConn net.Conn) {
+	req.endHandshake()
+	req.h.Metrics.addTunnel(tunnelStateActive, 1)
+	defer req.h.Metrics.addTunnel(tunnelStateActive, -1)
+
+	switch c := remoteConn.(type) {
+	case *net.TCPConn:
+		req.handleNetwork(wsConn, c)
+	case *net.UDPConn:
+		req.handleNetworkUdp(wsConn, c)
+	}
+}
+
+func (req *request) handleMuxConn() {
+	req.logDebugf("mux conn")
+	req.tunnel.setTarget(ProtocolMux, "")
+
+	respHeader := make(http.Header)
+	respHeader.Set(HeaderKeyId, req.id.String())
+	wsConn, err := req.h.WebsocketUpgrader.Upgrade(req.w, req.r, respHeader)
+	if err != nil {
+		req.h.Metrics.handshakeFailure(failureUpgrade)
+		req.with(logger.F("error", err)).logErrorf("websocket upgrade failure: %v", err)
+		return
+	}
+	defer func() {
+		err = wsConn.Close()
+		req.logDebugf("close of ws underlying conn: %v", err)
+	}()
+	req.tunnel.addCloser(wsConn)
+	req.logDebugf("ws upgraded")
+
+	s := newMuxSession(req.id, wsConn, false, req.h.Logger, req.h.LogLevel, req.h.LogTarget)
+	a := newActivity()
+	s.accept = func(st *muxStream, msg *reqMessage) {
+		req.handleMuxStream(st, msg)
+		a.touch()
+	}
+	if !req.tunnel.setDrainFunc(s.Drain) {
+		s.Drain()
+	}
+	req.endHandshake()
+	idle := func() time.Duration {
+		if s.NumStreams() > 0 {
+			a.touch()
+			return 0
+		}
+		return a.idle()
+	}
+	stop := watchTimeouts(req.start, req.h.TunnelMaxLifetime, req.h.TunnelIdleTimeout, idle, func(reason string) {
+		req.reason.set(reason)
+		s.shutdown(ErrMuxSessionClosed)
+		_ = wsConn.Close()
+	})
+	// no pinger on server
+	s.readLoop()
+	stop()
+
+	s.acceptWg.Wait()
+	reason := req.closeReason("")
+	req.with(logger.F("duration", time.Since(req.start)), logger.F("close_reason", reason)).logInfof("mux closed%s", closedBy(reason))
+}
+
+func (req *request) handleMuxStream(st *muxStream, msg *reqMessage) {
+	defer st.Close()
+
+	if msg.Protocol != ProtocolTCP {
+		st.reset(ErrorCodeUnsupported, "unsupported protocol")
+		req.h.Metrics.handshakeFailure(failureUnsupported)
+		req.with(logger.F("stream", st.id)).logWarnf("stream %d unsupported protocol %s", st.id, msg.Protocol)
+		return
+	}
+
+	if req.quotaExceeded() {
+		st.reset(ErrorCodeQuotaExceeded, "quota exceeded")
+		return
+	}
+
+	streamFields := []logger.Field{logger.F("stream", st.id), logger.F("protocol", msg.Protocol), logger.F("target", req.logTarget(msg.Target))}
+	removeTunnel, err := req.h.Limits.addTunnel(req.user, msg.Target)
+	if err != nil {
+		st.reset(ErrorCodeLimitExceeded, err.Error())
+		req.limitExceeded(err, streamFields...)
+		return
+	}
+	defer removeTunnel()
+	req.with(streamFields...).logInfof("stream %d connect %s %s", st.id, msg.Protocol, req.logTarget(msg.Target))
+	remoteConn, err := req.dialTarget(msg.Protocol, msg.Target)
+	if err != nil {
+		st.reset(dialErrorCode(err), fmt.Sprintf("Connection failure: %v", err))
+		logErr := req.logError(err, msg.Target)
+		req.with(append(streamFields, logger.F("error", logErr))...).logErrorf("stream %d connection failure: %v", st.id, logErr)
+		return
+	}
+	req.logDebugf("stream %d connected", st.id)
+	defer remoteConn.Close()
+	st.setOnAbort(func() {
+		remoteConn.Close()
+	})
+
+	err = st.s.writeFrame(muxFrameOpenOk, st.id, nil)
+	if err != nil {
+		req.with(append(streamFields, logger.F("error", err))...).logErrorf("stream %d response failure: %v", st.id, err)
+		return
+	}
+
+	start := time.Now()
+	req.h.Metrics.addTunnel(tunnelStateActive, 1)
+	var streamReason closeReason
+	a := newActivity()
+	stop := watchTimeouts(start, 0, req.h.TunnelIdleTimeout, a.idle, func(reason string) {
+		streamReason.set(reason)
+		st.reset(ErrorCodeTimeout, "stream closed by "+reason)
+	})
+	sent, received := req.pipe(st, remoteConn.(*net.TCPConn), a)
+	stop()
+	req.h.Metrics.addTunnel(tunnelStateActive, -1)
+	req.h.Metrics.addBytes(req.user, sent, received)
+	reason := req.closeReason(streamReason.get())
+	req.h.Metrics.tunnelClosed(reason)
+	req.with(append(streamFields, transferFields(sent, received, time.Since(start), reason)...)...).
+		logInfof("stream %d closed%s, sent %d bytes, received %d bytes", st.id, closedBy(reason), sent, received)
 }
 
 func (req *request) handleNetwork(wsConn *websocket.Conn, remoteConn TCPConn) {
@@ -191,6 +722,29 @@ func (req *request) handleNetwork(wsConn *websocket.Conn, remoteConn TCPConn) {
 	clientConn.init()
 	// no pinger on server
 
+	a := newActivity()
+	stop := req.watchTimeouts(a.idle, wsConn, remoteConn)
+	sent, received := req.pipe(clientConn, remoteConn, a)
+	stop()
+	req.h.Metrics.addBytes(req.user, sent, received)
+	reason := req.closeReason("")
+	req.h.Metrics.tunnelClosed(reason)
+	req.with(transferFields(sent, received, time.Since(req.start), reason)...).
+		logInfof("connection closed%s, sent %d bytes, received %d bytes", closedBy(reason), sent, received)
+}
+
+// watchTimeouts closes the tunnel by TunnelIdleTimeout and TunnelMaxLifetime
+func (req *request) watchTimeouts(idle func() time.Duration, wsConn *websocket.Conn, remoteConn io.Closer) func() {
+	return watchTimeouts(req.start, req.h.TunnelMaxLifetime, req.h.TunnelIdleTimeout, idle, func(reason string) {
+		req.reason.set(reason)
+		_ = wsConn.Close()
+		_ = remoteConn.Close()
+	})
+}
+
+// pipe copies data between client and remote until both directions are closed, a is touched on transferring
+func (req *request) pipe(clientConn TCPConn, remoteConn TCPConn, a *activity) (int64, int64) {
+	upload, download := req.rateLimiters()
 	var wg sync.WaitGroup
 	var sent, received int64
 	wg.Add(2)
@@ -198,17 +752,116 @@ func (req *request) handleNetwork(wsConn *websocket.Conn, remoteConn TCPConn) {
 		defer wg.Done()
 		defer clientConn.CloseWrite()
 		var err error
-		sent, err = io.Copy(clientConn, remoteConn)
+		sent, err = io.Copy(&countingWriter{w: ratelimit.NewWriter(clientConn, download...), add: func(n int64) {
+			a.touch()
+			req.addSent(n)
+		}}, remoteConn)
 		req.logDebugf("io_copy end 1: %v", err)
 	}()
 	go func() {
 		defer wg.Done()
 		defer remoteConn.CloseWrite()
 		var err error
-		received, err = io.Copy(remoteConn, clientConn)
+		received, err = io.Copy(&countingWriter{w: ratelimit.NewWriter(remoteConn, upload...), add: func(n int64) {
+			a.touch()
+			req.addReceived(n)
+		}}, clientConn)
 		req.logDebugf("io_copy end 2: %v", err)
 	}()
 
 	wg.Wait()
-	req.logInfof("connection closed, sent %d bytes, received %d bytes", sent, received)
+	return sent, received
+}
+
+func (req *request) handleNetworkUdp(wsConn *websocket.Conn, remoteConn *net.UDPConn) {
+	idleTimeout := req.h.UDPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 60 * time.Second
+	}
+	lastActive := time.Now().UnixNano()
+	touch := func() {
+		atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+	}
+
+	stop := req.watchTimeouts(func() time.Duration {
+		return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&lastActive))
+	}, wsConn, remoteConn)
+
+	upload, download := req.rateLimiters()
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			_ = wsConn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "ok"),
+				time.Now().Add(time.Second),
+			)
+			_ = wsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		}()
+
+		buf := make([]byte, 64*1024)
+		for {
+			_ = remoteConn.SetReadDeadline(time.Now().Add(idleTimeout))
+			n, err := remoteConn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&lastActive))
+					if idle < idleTimeout {
+						continue
+					}
+					req.logDebugf("udp idle timeout")
+					return
+				}
+				req.logDebugf("udp read end: %v", err)
+				return
+			}
+			touch()
+
+			ratelimit.Wait(n, download...)
+			err = wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
+			if err != nil {
+				req.logDebugf("udp write ws end: %v", err)
+				return
+			}
+			sent += int64(n)
+			req.addSent(int64(n))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer remoteConn.Close()
+
+		for {
+			mt, data, err := wsConn.ReadMessage()
+			if err != nil {
+				req.logDebugf("udp read ws end: %v", err)
+				return
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			touch()
+
+			ratelimit.Wait(len(data), upload...)
+			_, err = remoteConn.Write(data)
+			if err != nil {
+				req.logDebugf("udp write err: %v", err)
+				continue
+			}
+			received += int64(len(data))
+			req.addReceived(int64(len(data)))
+		}
+	}()
+
+	wg.Wait()
+	stop()
+	req.h.Metrics.addBytes(req.user, sent, received)
+	reason := req.closeReason("")
+	req.h.Metrics.tunnelClosed(reason)
+	req.with(transferFields(sent, received, time.Since(req.start), reason)...).
+		logInfof("connection closed%s, sent %d bytes, received %d bytes", closedBy(reason), sent, received)
 }
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons of closing tunnels, in logs and metrics
+const (
+	closeReasonNormal      = "normal"
+	closeReasonIdleTimeout = "idle_timeout"
+	closeReasonMaxLifetime = "max_lifetime"
+	closeReasonAdmin       = "admin"
+	closeReasonQuota       = "quota"
+	closeReasonShutdown    = "shutdown"
+)
+
+// closeReason keeps the first reason of closing
+type closeReason struct {
+	mutex  sync.Mutex
+	reason string
+}
+
+func (r *closeReason) set(reason string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.reason == "" {
+		r.reason = reason
+	}
+}
+
+// get returns the reason, or empty if not closed for a reason
+func (r *closeReason) get() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reason
+}
+
+// activity is the last time of transferring data in unix nanoseconds, accessed atomically
+type activity int64
+
+func newActivity() *activity {
+	a := new(activity)
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64((*int64)(a), time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64((*int64)(a)))
+}
+
+// watchTimeouts calls abort once idle returns idleTimeout or more, or the lifetime since start is over,
+// zero durations mean no limits. It returns the function to stop watching.
+func watchTimeouts(start time.Time, lifetime, idleTimeout time.Duration, idle func() time.Duration, abort func(reason string)) func() {
+	if lifetime <= 0 && idleTimeout <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+
+			wait := time.Duration(-1)
+			if lifetime > 0 {
+				wait = lifetime - time.Since(start)
+				if wait <= 0 {
+					abort(closeReasonMaxLifetime)
+					return
+				}
+			}
+			if idleTimeout > 0 {
+				idleWait := idleTimeout - idle()
+				if idleWait <= 0 {
+					abort(closeReasonIdleTimeout)
+					return
+				}
+				if wait < 0 || idleWait < wait {
+					wait = idleWait
+				}
+			}
+			timer.Reset(wait)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// closedBy returns the text of the reason in logs, empty for normal closing
+func closedBy(reason string) string {
+	if reason == closeReasonNormal {
+		return ""
+	}
+	return " by " + reason
+}
@@ -0,0 +1,311 @@
+package protocol
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelInfo is a snapshot of an in-flight request
+type TunnelInfo struct {
+	Id       string    `json:"id"`
+	RealIp   string    `json:"real_ip"`
+	User     string    `json:"user"`
+	Protocol string    `json:"protocol"`
+	Target   string    `json:"target"`
+	Start    time.Time `json:"start"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+}
+
+type tunnel struct {
+	// accessed atomically
+	sent     int64
+	received int64
+
+	id     string
+	realIp string
+	user   string
+	start  time.Time
+
+	mutex    sync.Mutex
+	protocol string
+	target   string
+	closers  []io.Closer
+	closed   bool
+	// drainFunc is called when draining, to close the tunnel if it's not carrying data
+	drainFunc func()
+	draining  bool
+	reason    closeReason
+}
+
+func (t *tunnel) setTarget(proto, target string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.protocol = proto
+	t.target = target
+}
+
+// addCloser registers c to be closed on termination, c is closed at once if already terminated
+func (t *tunnel) addCloser(c io.Closer) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	if !t.closed {
+		t.closers = append(t.closers, c)
+		t.mutex.Unlock()
+		return
+	}
+	t.mutex.Unlock()
+	_ = c.Close()
+}
+
+// setDrainFunc sets the function called when draining, returns false if it's already draining
+func (t *tunnel) setDrainFunc(f func()) bool {
+	if t == nil {
+		return true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.draining {
+		return false
+	}
+	t.drainFunc = f
+	return true
+}
+
+func (t *tunnel) drain() {
+	t.mutex.Lock()
+	t.draining = true
+	f := t.drainFunc
+	t.drainFunc = nil
+	t.mutex.Unlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+func (t *tunnel) addSent(n int64) {
+	if t != nil {
+		atomic.AddInt64(&t.sent, n)
+	}
+}
+
+func (t *tunnel) addReceived(n int64) {
+	if t != nil {
+		atomic.AddInt64(&t.received, n)
+	}
+}
+
+// closeReason returns the reason if the tunnel is closed by Tunnels, otherwise empty
+func (t *tunnel) closeReason() string {
+	if t == nil {
+		return ""
+	}
+	return t.reason.get()
+}
+
+func (t *tunnel) close(reason string) {
+	t.reason.set(reason)
+	t.mutex.Lock()
+	closers := t.closers
+	t.closers = nil
+	t.closed = true
+	t.mutex.Unlock()
+
+	for _, c := range closers {
+		_ = c.Close()
+	}
+}
+
+func (t *tunnel) info() TunnelInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return TunnelInfo{
+		Id:       t.id,
+		RealIp:   t.realIp,
+		User:     t.user,
+		Protocol: t.protocol,
+		Target:   t.target,
+		Start:    t.start,
+		Sent:     atomic.LoadInt64(&t.sent),
+		Received: atomic.LoadInt64(&t.received),
+	}
+}
+
+// Tunnels keeps in-flight requests of handlers, methods are no-op on nil
+type Tunnels struct {
+	mutex    sync.Mutex
+	tunnels  map[string]*tunnel
+	draining bool
+}
+
+func NewTunnels() *Tunnels {
+	return &Tunnels{
+		tunnels: make(map[string]*tunnel),
+	}
+}
+
+// add registers the request, returns false if it's draining
+func (ts *Tunnels) add(req *request) (*tunnel, bool) {
+	if ts == nil {
+		return nil, true
+	}
+	t := &tunnel{
+		id:     req.id.String(),
+		realIp: req.realIp,
+		user:   req.user,
+		start:  time.Now(),
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.draining {
+		return nil, false
+	}
+	ts.tunnels[t.id] = t
+	return t, true
+}
+
+func (ts *Tunnels) remove(t *tunnel) {
+	if ts == nil || t == nil {
+		return
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	delete(ts.tunnels, t.id)
+}
+
+// List returns in-flight requests ordered by start time
+func (ts *Tunnels) List() []TunnelInfo {
+	if ts == nil {
+		return nil
+	}
+	ts.mutex.Lock()
+	result := make([]TunnelInfo, 0, len(ts.tunnels))
+	for _, t := range ts.tunnels {
+		result = append(result, t.info())
+	}
+	ts.mutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return result
+}
+
+func (ts *Tunnels) Get(id string) (TunnelInfo, bool) {
+	if ts == nil {
+		return TunnelInfo{}, false
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	t, ok := ts.tunnels[id]
+	if !ok {
+		return TunnelInfo{}, false
+	}
+	return t.info(), true
+}
+
+// Close terminates the request of the id, which is sent to clients in the header X-PROXY-ID
+func (ts *Tunnels) Close(id string) bool {
+	if ts == nil {
+		return false
+	}
+	ts.mutex.Lock()
+	t, ok := ts.tunnels[id]
+	ts.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	t.close(closeReasonAdmin)
+	return true
+}
+
+// CloseUser closes tunnels of the user out of quota, returns the number of them
+func (ts *Tunnels) CloseUser(user string) int {
+	if ts == nil {
+		return 0
+	}
+	var list []*tunnel
+	ts.mutex.Lock()
+	for _, t := range ts.tunnels {
+		if t.user == user {
+			list = append(list, t)
+		}
+	}
+	ts.mutex.Unlock()
+
+	for _, t := range list {
+		t.close(closeReasonQuota)
+	}
+	return len(list)
+}
+
+func (ts *Tunnels) Len() int {
+	if ts == nil {
+		return 0
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return len(ts.tunnels)
+}
+
+// Drain rejects new requests, closes tunnels which are not carrying data, and waits for the others to finish.
+// Tunnels still open when ctx is done are closed, the number of them is returned.
+func (ts *Tunnels) Drain(ctx context.Context) int {
+	if ts == nil {
+		return 0
+	}
+	ts.mutex.Lock()
+	ts.draining = true
+	tunnels := make([]*tunnel, 0, len(ts.tunnels))
+	for _, t := range ts.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	ts.mutex.Unlock()
+
+	for _, t := range tunnels {
+		t.drain()
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for ts.Len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			ts.mutex.Lock()
+			tunnels = tunnels[:0]
+			for _, t := range ts.tunnels {
+				tunnels = append(tunnels, t)
+			}
+			ts.mutex.Unlock()
+
+			for _, t := range tunnels {
+				t.close(closeReasonShutdown)
+			}
+			return len(tunnels)
+		}
+	}
+	return 0
+}
+
+// countingWriter counts written bytes with add
+type countingWriter struct {
+	w   io.Writer
+	add func(int64)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,223 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Token buckets allow debts of at most 20ms of the rate: a write admitted takes tokens at once and sleeps until
+// the debt is paid, others wait until they fit in the debt without taking anything. Writes are split into chunks
+// of at most 20ms of the rate, so that concurrent writers take turns, and a small write like a key stroke of SSH
+// fits in the debt before the next chunk, however many other writers there are.
+const (
+	burstDuration = 200 * time.Millisecond
+	chunkDuration = 20 * time.Millisecond
+	minChunk      = 1024
+	maxChunk      = 32 * 1024
+)
+
+// Limiter is a token bucket of bytes, methods are no-op on nil
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of rate bytes per second, zero means unlimited
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{
+		rate: float64(rate),
+		last: time.Now(),
+	}
+	l.tokens = l.burst()
+	return l
+}
+
+// SetRate changes the rate in bytes per second, zero means unlimited
+func (l *Limiter) SetRate(rate int64) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = float64(rate)
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int64(l.rate)
+}
+
+// burst returns the max tokens, l.mutex must be held
+func (l *Limiter) burst() float64 {
+	return l.rate * burstDuration.Seconds()
+}
+
+// reserve takes n tokens if they fit in the debt, returns how long to wait for them and whether they are taken.
+// If not taken, it's how long to wait until they fit.
+func (l *Limiter) reserve(n int, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		l.last = now
+		return 0, true
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+	l.last = now
+
+	// a write larger than the max debt is admitted once there is no debt
+	least := float64(n) - l.rate*chunkDuration.Seconds()
+	if least > 0 {
+		least = 0
+	}
+	if l.tokens < least {
+		return time.Duration((least - l.tokens) / l.rate * float64(time.Second)), false
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), true
+}
+
+// refund gives back n tokens taken by reserve
+func (l *Limiter) refund(n int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate > 0 {
+		l.tokens += float64(n)
+	}
+}
+
+// chunk returns the size of chunks to write, or 0 if unlimited
+func (l *Limiter) chunk() int {
+	rate := l.Rate()
+	if rate <= 0 {
+		return 0
+	}
+	n := int(float64(rate) * chunkDuration.Seconds())
+	if n < minChunk {
+		return minChunk
+	}
+	if n > maxChunk {
+		return maxChunk
+	}
+	return n
+}
+
+// Wait blocks until n bytes are allowed by all the limiters.
+// Tokens are taken from all of them only if all of them admit the write, so shared ones are not charged while
+// it waits for others.
+func Wait(n int, limiters ...*Limiter) {
+	for {
+		now := time.Now()
+		var wait time.Duration
+		admitted := true
+		for i, l := range limiters {
+			d, ok := l.reserve(n, now)
+			if !ok {
+				for _, taken := range limiters[:i] {
+					taken.refund(n)
+				}
+				wait, admitted = d, false
+				break
+			}
+			if d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		if admitted {
+			return
+		}
+	}
+}
+
+type writer struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter returns a writer to w limited by all the limiters, nil ones are ignored
+func NewWriter(w io.Writer, limiters ...*Limiter) io.Writer {
+	var list []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			list = append(list, l)
+		}
+	}
+	if len(list) == 0 {
+		return w
+	}
+	return &writer{w: w, limiters: list}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		for _, l := range w.limiters {
+			if c := l.chunk(); c > 0 && c < n {
+				n = c
+			}
+		}
+		Wait(n, w.limiters...)
+		m, err := w.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Group keeps a limiter of each key, like users
+type Group struct {
+	mutex    sync.Mutex
+	limiters map[string]*Limiter
+}
+
+func NewGroup() *Group {
+	return &Group{
+		limiters: make(map[string]*Limiter),
+	}
+}
+
+// Get returns the limiter of the key, which is set to rate. It returns nil if rate is zero.
+func (g *Group) Get(key string, rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	l := g.limiters[key]
+	if l == nil {
+		l = NewLimiter(rate)
+		g.limiters[key] = l
+		return l
+	}
+	l.SetRate(rate)
+	return l
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLimiter(100 * 1024)
+	w := NewWriter(&buf, l, nil)
+
+	start := time.Now()
+	// 20 KB of burst, then 100 KB/s
+	n, err := w.Write(make([]byte, 70*1024))
+	if err != nil || n != 70*1024 || buf.Len() != 70*1024 {
+		t.Fatalf("write failure: %d %v", n, err)
+	}
+	d := time.Since(start)
+	if d < 400*time.Millisecond || d > 700*time.Millisecond {
+		t.Fatalf("unexpected duration: %v", d)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var buf bytes.Buffer
+	if NewWriter(&buf, nil) != io.Writer(&buf) {
+		t.Fatalf("writer wrapped without limiters")
+	}
+
+	l := NewLimiter(0)
+	start := time.Now()
+	Wait(100*1024*1024, l)
+	if time.Since(start) > 10*time.Millisecond {
+		t.Fatalf("unlimited limiter waits")
+	}
+}
+
+func TestHierarchy(t *testing.T) {
+	global := NewLimiter(200 * 1024)
+	g := NewGroup()
+	if g.Get("alice", 0) != nil {
+		t.Fatalf("limiter of zero rate")
+	}
+
+	// alice is limited to half of the global rate, bob gets the rest
+	var wg sync.WaitGroup
+	durations := make(map[string]time.Duration)
+	var mutex sync.Mutex
+	start := time.Now()
+	for _, c := range []struct {
+		user string
+		rate int64
+		size int
+	}{
+		{"alice", 100 * 1024, 50 * 1024},
+		{"bob", 0, 50 * 1024},
+	} {
+		wg.Add(1)
+		go func(user string, rate int64, size int) {
+			defer wg.Done()
+			w := NewWriter(io.Discard, global, g.Get(user, rate))
+			w.Write(make([]byte, size))
+			mutex.Lock()
+			durations[user] = time.Since(start)
+			mutex.Unlock()
+		}(c.user, c.rate, c.size)
+	}
+	wg.Wait()
+
+	// 100 KB in total, minus the global burst of 40 KB, at 200 KB/s
+	total := durations["alice"]
+	if durations["bob"] > total {
+		total = durations["bob"]
+	}
+	if total < 250*time.Millisecond || total > 500*time.Millisecond {
+		t.Fatalf("unexpected durations: %v", durations)
+	}
+	// alice: 50 KB minus the burst of 20 KB, at most 100 KB/s
+	if durations["alice"] < 250*time.Millisecond {
+		t.Fatalf("alice not limited: %v", durations)
+	}
+}
+
+func TestInteractive(t *testing.T) {
+	global := NewLimiter(100 * 1024)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(stop)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := NewWriter(io.Discard, global, NewLimiter(1024*1024))
+			data := make([]byte, 2*1024)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w.Write(data)
+			}
+		}()
+	}
+	// the burst is used up by bulk writers
+	time.Sleep(500 * time.Millisecond)
+
+	// a key stroke waits for about a chunk of 20ms, not a chunk of each bulk writer
+	w := NewWriter(io.Discard, global, NewLimiter(1024*1024))
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		w.Write(make([]byte, 16))
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Fatalf("small write waits for %v", d)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+)
+
+// reload loads and checks the config file again, then calls apply with the new config.
+// apply makes everything before applying any of it, so a failure leaves the previous config in effect.
+func reload(apply func(c *Config) error) {
+	logInfof("reloading config")
+
+	var c Config
+	err := loadConfig(&c)
+	if err == nil {
+		err = checkConfig(&c)
+	}
+	if err == nil {
+		err = checkReloadable(currentConfig(), &c)
+	}
+	var al *appLogger
+	if err == nil {
+		al, err = newAppLogger(&c)
+	}
+	if err == nil {
+		err = apply(&c)
+	}
+	if err != nil {
+		logErrorf("reload rejected: %v", err)
+		return
+	}
+
+	current.Store(&c)
+	setAppLogger(al)
+	shaping.apply(c.RateLimit)
+	logInfof("config reloaded")
+}
+
+// checkReloadable checks options which cannot be changed without restarting
+func checkReloadable(old, c *Config) error {
+	switch {
+	case c.Mode != old.Mode:
+		return errors.New("mode cannot be changed by reload")
+	case c.Listen != old.Listen:
+		return errors.New("listen cannot be changed by reload")
+	case c.Insecure != old.Insecure || c.TLSCert != old.TLSCert || c.TLSKey != old.TLSKey:
+		return errors.New("insecure, tls_cert and tls_key cannot be changed by reload")
+	case c.AdminListen != old.AdminListen || c.AdminKey != old.AdminKey:
+		return errors.New("admin_listen and admin_key cannot be changed by reload")
+	case c.LogOutput != old.LogOutput || c.LogFile != old.LogFile || c.LogAddress != old.LogAddress ||
+		c.LogFileMaxSize != old.LogFileMaxSize || c.LogFileMaxAge != old.LogFileMaxAge ||
+		c.LogFileMaxBackups != old.LogFileMaxBackups:
+		return errors.New("log_output, log_file* and log_address cannot be changed by reload")
+	case c.BanFile != old.BanFile:
+		return errors.New("ban_file cannot be changed by reload")
+	case c.UsageFile != old.UsageFile:
+		return errors.New("usage_file cannot be changed by reload")
+	}
+	return nil
+}
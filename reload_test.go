@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestReload(t *testing.T) {
+	oldCfg, oldConfigPath := cfg, *fConfig
+	defer func() {
+		cfg, *fConfig = oldCfg, oldConfigPath
+		current = atomic.Value{}
+	}()
+
+	*fConfig = filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(content string) {
+		err := os.WriteFile(*fConfig, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("write config failure: %v", err)
+		}
+	}
+	writeConfig(`{"mode": "server", "listen": "127.0.0.1:10088", "key": "12345", "endpoint": "/proxy", "insecure": true}`)
+	cfg = Config{}
+	err := loadConfig(&cfg)
+	if err != nil {
+		t.Fatalf("load config failure: %v", err)
+	}
+
+	s := &Server{
+		tunnels: protocol.NewTunnels(),
+	}
+	_, err = s.build(&cfg)
+	if err != nil {
+		t.Fatalf("build failure: %v", err)
+	}
+
+	errCh := make(chan error)
+	go func() {
+		err := http.ListenAndServe("127.0.0.1:10088", s)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10098")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				t.Log("accept failure", err)
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	echo := func(conn protocol.TCPConn) error {
+		_, err := conn.Write([]byte("333"))
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+		if string(buf) != "333" {
+			return errors.New("client read data")
+		}
+		return nil
+	}
+
+	apply := func(c *Config) error {
+		_, err := s.build(c)
+		return err
+	}
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		conn, err := dialer.Dial("ws://127.0.0.1:10088/proxy", "12345", "tcp", "127.0.0.1:10098")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+
+		writeConfig(`{"mode": "server", "listen": "127.0.0.1:10088", "key": "54321", "endpoint": "/proxy", "insecure": true}`)
+		reload(apply)
+
+		_, err = dialer.Dial("ws://127.0.0.1:10088/proxy", "12345", "tcp", "127.0.0.1:10098")
+		if err == nil {
+			errCh <- errors.New("old key is accepted after reload")
+			return
+		}
+		conn2, err := dialer.Dial("ws://127.0.0.1:10088/proxy", "54321", "tcp", "127.0.0.1:10098")
+		if err != nil {
+			errCh <- fmt.Errorf("new key: %v", err)
+			return
+		}
+		conn2.Close()
+
+		// the tunnel before reload keeps running
+		err = echo(conn)
+		if err != nil {
+			errCh <- fmt.Errorf("tunnel before reload: %v", err)
+			return
+		}
+
+		for _, content := range []string{
+			`{"mode": "server", "listen": "127.0.0.1:10088", "key": "11111", "endpoint": "/proxy", "insecure": true, "auth_scheme": "unknown"}`,
+			`{"mode": "server", "listen": "127.0.0.1:10089", "key": "11111", "endpoint": "/proxy", "insecure": true}`,
+			`{"mode": "server", `,
+		} {
+			writeConfig(content)
+			reload(apply)
+			if currentConfig().Key != "54321" {
+				errCh <- fmt.Errorf("invalid config is applied: %s", content)
+				return
+			}
+		}
+		conn2, err = dialer.Dial("ws://127.0.0.1:10088/proxy", "54321", "tcp", "127.0.0.1:10098")
+		if err != nil {
+			errCh <- fmt.Errorf("after rejected reload: %v", err)
+			return
+		}
+		conn2.Close()
+
+		errCh <- nil
+	}()
+
+	err = <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestBuildFailure(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{
+		Mode:        modeServer,
+		Key:         "12345",
+		Endpoint:    "/proxy",
+		UsageFile:   filepath.Join(dir, "usage.json"),
+		FallbackDir: filepath.Join(dir, "none"),
+	}
+	s := &Server{tunnels: protocol.NewTunnels()}
+	_, err := s.build(&c)
+	if err == nil {
+		t.Fatalf("build with an invalid fallback_dir succeeded")
+	}
+	// nothing is applied before the failure
+	if s.bans != nil || s.usage != nil || s.limits != nil || s.mux.Load() != nil {
+		t.Fatalf("server is changed by the failed build")
+	}
+}
@@ -1,45 +1,337 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"sync/atomic"
+	"time"
 	"weisuo/logger"
 	"weisuo/protocol"
 	"weisuo/serverhelper"
+	"weisuo/token"
 )
 
+const (
+	defaultBanWindow      = time.Minute
+	defaultBanDuration    = 10 * time.Minute
+	defaultBanMaxDuration = 24 * time.Hour
+
+	usageSaveInterval  = 30 * time.Second
+	quotaCheckInterval = 10 * time.Second
+)
+
+// Server serves with the mux made by the config, which is replaced on reload.
+// Tunnels, metrics, limits and the nonce cache of hmac are kept across reloads.
+type Server struct {
+	mux     atomic.Value // *http.ServeMux
+	tunnels *protocol.Tunnels
+	metrics *protocol.Metrics
+	limits  *protocol.Limits
+	users   *serverhelper.UserStore
+	hmac    *hmacVerifier
+	bans    *serverhelper.BanList
+	usage   *serverhelper.UsageStore
+	quota   atomic.Value // *serverhelper.QuotaConfig
+}
+
+// hmacVerifier is the verifier of key and maxSkew, it's recreated only if either is changed
+type hmacVerifier struct {
+	key     string
+	maxSkew time.Duration
+	v       *token.Verifier
+}
+
 func runServer() {
+	s := &Server{
+		tunnels: protocol.NewTunnels(),
+	}
+	// metrics are counted anyway, so that metrics_endpoint can be enabled by reloading
+	s.metrics = protocol.NewMetrics()
+	h, err := s.build(&cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.AdminListen != "" {
+		runAdmin(s.tunnels, s.bans)
+	}
+	if s.usage != nil {
+		go s.checkQuota()
+	}
+
+	server := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: s,
+	}
+	go func() {
+		var err error
+		if cfg.Insecure {
+			err = server.ListenAndServe()
+		} else {
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("server listen failure: %v", err)
+		}
+	}()
+
+	ctx, cancel := waitForShutdown(func(c *Config) error {
+		newH, err := s.build(c)
+		if err != nil {
+			return err
+		}
+		h = newH
+		return nil
+	})
+	defer cancel()
+	logInfof("shutting down, draining tunnels")
+	go server.Shutdown(ctx)
+	n := h.Shutdown(ctx)
+	logInfof("server shutdown, %d tunnels closed forcibly", n)
+	if s.usage != nil {
+		err = s.usage.Stop()
+		if err != nil {
+			logErrorf("%v", err)
+		}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Load().(*http.ServeMux).ServeHTTP(w, r)
+}
+
+// build makes the handler by c, and serves with it. Requests in flight keep using the previous handler.
+// Everything which may fail is done first, and nothing of the server is changed until then,
+// so that a failure leaves the server as it was.
+func (s *Server) build(c *Config) (*protocol.Handler, error) {
 	h := protocol.DefaultHandler()
-	h.Authenticator = serverhelper.StaticKeyAuthenticator(cfg.Key)
-	h.LogLevel = logger.GetLevel(cfg.LogLevel)
-	serverPreset(h)
+	h.Tunnels = s.tunnels
+	h.Metrics = s.metrics
+
+	if c.TargetACL != nil {
+		acl, err := serverhelper.NewACL(c.TargetACL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target_acl: %v", err)
+		}
+		h.TargetFilter = acl.Allow
+	}
+	authenticator, applyAuth, err := s.authenticator(c)
+	if err != nil {
+		return nil, err
+	}
+	h.Authenticator = authenticator
+	bans := s.bans
+	if bans == nil {
+		// ban_file cannot be reloaded, so it's loaded once at startup
+		bans, err = serverhelper.NewBanList(c.BanFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.BanMaxFailures > 0 {
+		h.Authenticator = bans.Authenticator(authenticator)
+	}
+	usage, err := s.loadUsage(c)
+	if err != nil {
+		return nil, err
+	}
+	accounting(c, h, usage)
+	h.Logger, err = makeLogger(c)
+	if err != nil {
+		return nil, err
+	}
+	h.LogLevel = logger.GetLevel(c.LogLevel)
+	h.LogTarget = makeLogTarget(c)
+	if c.UDPIdleTimeout > 0 {
+		h.UDPIdleTimeout = time.Duration(c.UDPIdleTimeout) * time.Second
+	}
+	limits := s.limits
+	if limits == nil {
+		limits = protocol.NewLimits()
+	}
+	h.Limits = limits
+	h.IdleRequestTimeout = time.Duration(c.IdleRequestTimeout) * time.Second
+	h.TunnelIdleTimeout = time.Duration(c.TunnelIdleTimeout) * time.Second
+	h.TunnelMaxLifetime = time.Duration(c.TunnelMaxLifetime) * time.Second
+	initPreset, err := serverPreset(c, h)
+	if err != nil {
+		return nil, err
+	}
+	h.Fallback, err = makeFallback(c)
+	if err != nil {
+		return nil, err
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle(cfg.Endpoint, h)
-	if cfg.SpeedTestEndpoint != "" {
-		mux.HandleFunc(cfg.SpeedTestEndpoint, serverhelper.SpeedTestHelper)
+	mux.Handle(c.Endpoint, h)
+	if h.Fallback != nil && c.Endpoint != "/" {
+		// unknown paths
+		mux.Handle("/", h.Fallback)
 	}
+	if c.SpeedTestEndpoint != "" {
+		mux.HandleFunc(c.SpeedTestEndpoint, serverhelper.SpeedTestHelper)
+	}
+	if c.MetricsEndpoint != "" {
+		mux.Handle(c.MetricsEndpoint, metricsHandler(s.metrics, c.MetricsKey))
+	}
+	if c.RateLimit != nil {
+		h.RateLimit = shaping.limiters
+	}
+
+	// nothing fails from here
+	applyAuth()
+	s.bans = bans
+	bans.SetPolicy(int(c.BanMaxFailures), banSeconds(c.BanWindow, defaultBanWindow),
+		banSeconds(c.BanDuration, defaultBanDuration), banSeconds(c.BanMaxDuration, defaultBanMaxDuration))
+	if usage != nil && s.usage == nil {
+		usage.Run(usageSaveInterval)
+		s.usage = usage
+	}
+	s.limits = limits
+	limits.SetConfig(protocol.LimitConfig{
+		MaxHandshakes:       int(c.MaxHandshakes),
+		MaxTunnelsPerUser:   int(c.MaxTunnelsPerUser),
+		MaxIdlePerUser:      int(c.MaxIdlePerUser),
+		MaxIdlePerIp:        int(c.MaxIdlePerIp),
+		MaxTunnelsPerTarget: int(c.MaxTunnelsPerTarget),
+	})
+	initPreset()
+	s.quota.Store(c.Quota)
+	s.mux.Store(mux)
+	return h, nil
+}
 
-	var err error
-	if cfg.Insecure {
-		err = http.ListenAndServe(cfg.Listen, mux)
-	} else {
-		err = http.ListenAndServeTLS(cfg.Listen, cfg.TLSCert, cfg.TLSKey, mux)
+// authenticator makes the authenticator of c, and the function to apply it once the whole config is made
+func (s *Server) authenticator(c *Config) (protocol.AuthenticatorFunc, func(), error) {
+	if c.UsersFile == "" {
+		stopUsers := func() {
+			if s.users != nil {
+				s.users.Stop()
+				s.users = nil
+			}
+		}
+		if c.AuthScheme != authSchemeHmac {
+			return serverhelper.StaticKeyAuthenticator(c.Key), stopUsers, nil
+		}
+
+		hv := s.hmac
+		maxSkew := time.Duration(c.AuthMaxSkew) * time.Second
+		if hv == nil || hv.key != c.Key || hv.maxSkew != maxSkew {
+			hv = &hmacVerifier{key: c.Key, maxSkew: maxSkew, v: token.NewVerifier(c.Key, maxSkew, token.DefaultCacheSize)}
+		}
+		return serverhelper.VerifierAuthenticator(hv.v), func() {
+			stopUsers()
+			s.hmac = hv
+		}, nil
 	}
 
-	log.Fatalf("server listen failure: %v", err)
+	// the file is loaded again even if it's not changed, the store in use is replaced once the config is applied
+	users, err := serverhelper.LoadUserStore(c.UsersFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load users failure: %v", err)
+	}
+	return users.Authenticator(), func() {
+		users.Watch(5 * time.Second)
+		if s.users != nil {
+			s.users.Stop()
+		}
+		s.users = users
+	}, nil
+}
+
+// loadUsage returns the usage store of usage_file, it's not run until the config is applied
+func (s *Server) loadUsage(c *Config) (*serverhelper.UsageStore, error) {
+	if s.usage != nil || c.UsageFile == "" {
+		// usage_file cannot be reloaded, so it's loaded once at startup
+		return s.usage, nil
+	}
+	usage, err := serverhelper.LoadUsageStore(c.UsageFile)
+	if err != nil {
+		return nil, fmt.Errorf("load usage failure: %v", err)
+	}
+	return usage, nil
+}
+
+// accounting sets up usage and quota of the handler
+func accounting(c *Config, h *protocol.Handler, usage *serverhelper.UsageStore) {
+	if usage != nil {
+		h.Accounting = usage.Add
+	}
+
+	quota := c.Quota
+	if quota != nil {
+		h.Quota = func(user string) bool {
+			return !usage.Exceeded(user, quota.Limits(user))
+		}
+	}
+}
+
+// checkQuota closes tunnels of users out of quota periodically, if cut_active of quota is enabled
+func (s *Server) checkQuota() {
+	for range time.Tick(quotaCheckInterval) {
+		quota := s.quota.Load().(*serverhelper.QuotaConfig)
+		if quota == nil || !quota.CutActive {
+			continue
+		}
+		checked := make(map[string]bool)
+		for _, t := range s.tunnels.List() {
+			if checked[t.User] {
+				continue
+			}
+			checked[t.User] = true
+			if s.usage.Exceeded(t.User, quota.Limits(t.User)) {
+				n := s.tunnels.CloseUser(t.User)
+				logInfof("quota exceeded, %d tunnels of %s closed", n, t.User)
+			}
+		}
+	}
+}
+
+// metricsHandler serves metrics, requests must have the header `Authorization: Bearer key` if key is not empty
+func metricsHandler(metrics *protocol.Metrics, key string) http.Handler {
+	if key == "" {
+		return metrics
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bearerAuthorized(r, key) {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+func banSeconds(seconds uint, defaultValue time.Duration) time.Duration {
+	if seconds == 0 {
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// makeFallback returns the handler of fallback_dir or fallback_upstream, or nil if neither is specified
+func makeFallback(c *Config) (http.Handler, error) {
+	switch {
+	case c.FallbackDir != "":
+		return serverhelper.FallbackDir(c.FallbackDir)
+	case c.FallbackUpstream != "":
+		return serverhelper.FallbackUpstream(c.FallbackUpstream)
+	}
+	return nil, nil
 }
 
-func serverPreset(h *protocol.Handler) {
-	switch cfg.ServerPreset {
+// serverPreset sets the real IP of the handler by the preset of c, and returns the function to init the preset
+// once the config is applied
+func serverPreset(c *Config, h *protocol.Handler) (func(), error) {
+	switch c.ServerPreset {
 	case "":
-	case "cloudflare":
-		serverhelper.CloudflareInit()
+		return func() {}, nil
+	case serverPresetCloudflare:
 		h.RealIpFunc = serverhelper.CloudflareRealIpFunc
-	case "aws_cloudfront":
-		serverhelper.AwsCloudfrontInit()
+		return serverhelper.CloudflareInit, nil
+	case serverPresetAwsCloudfront:
 		h.RealIpFunc = serverhelper.AwsCloudfrontRealIpFunc
+		return serverhelper.AwsCloudfrontInit, nil
 	default:
-		log.Fatalf("unexpected server preset: %s", cfg.ServerPreset)
+		return nil, fmt.Errorf("unexpected server preset: %s", c.ServerPreset)
 	}
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"weisuo/protocol"
+	"weisuo/serverhelper"
+)
+
+const adminUnixPrefix = "unix:"
+
+var startTime = time.Now()
+
+type adminRuntimeStats struct {
+	GoVersion    string  `json:"go_version"`
+	Uptime       float64 `json:"uptime"`
+	NumCPU       int     `json:"num_cpu"`
+	NumGoroutine int     `json:"num_goroutine"`
+	NumTunnel    int     `json:"num_tunnel"`
+	HeapAlloc    uint64  `json:"heap_alloc"`
+	HeapInuse    uint64  `json:"heap_inuse"`
+	Sys          uint64  `json:"sys"`
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotalNs uint64  `json:"pause_total_ns"`
+}
+
+// adminHandler serves the admin API, requests are authorized by `Authorization: Bearer KEY`
+type adminHandler struct {
+	key     string
+	tunnels *protocol.Tunnels
+	bans    *serverhelper.BanList
+	mux     *http.ServeMux
+}
+
+func newAdminHandler(key string, tunnels *protocol.Tunnels, bans *serverhelper.BanList) *adminHandler {
+	a := &adminHandler{
+		key:     key,
+		tunnels: tunnels,
+		bans:    bans,
+		mux:     http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/tunnels", a.handleTunnels)
+	a.mux.HandleFunc("/tunnels/close", a.handleClose)
+	a.mux.HandleFunc("/bans", a.handleBans)
+	a.mux.HandleFunc("/bans/unban", a.handleUnban)
+	a.mux.HandleFunc("/runtime", a.handleRuntime)
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return a
+}
+
+// bearerAuthorized returns whether the request has the header `Authorization: Bearer key`
+func bearerAuthorized(r *http.Request, key string) bool {
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(key)) == 1
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, a.key) {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		logWarnf("admin unauthorized %s", r.RemoteAddr)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *adminHandler) handleTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, a.tunnels.List())
+}
+
+func (a *adminHandler) handleClose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	info, ok := a.tunnels.Get(id)
+	if !ok || !a.tunnels.Close(id) {
+		http.Error(w, "Tunnel not found", http.StatusNotFound)
+		return
+	}
+	logInfof("admin closed tunnel %s %s %s %s", info.Id, info.RealIp, info.User, info.Target)
+	writeJson(w, info)
+}
+
+func (a *adminHandler) handleBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.bans == nil {
+		writeJson(w, []serverhelper.Ban{})
+		return
+	}
+	writeJson(w, a.bans.List())
+}
+
+func (a *adminHandler) handleUnban(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := r.URL.Query().Get("ip")
+	if a.bans == nil || !a.bans.Unban(ip) {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	logInfof("admin unbanned %s", ip)
+	writeJson(w, map[string]string{"ip": ip})
+}
+
+func (a *adminHandler) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	writeJson(w, &adminRuntimeStats{
+		GoVersion:    runtime.Version(),
+		Uptime:       time.Since(startTime).Seconds(),
+		NumCPU:       runtime.NumCPU(),
+		NumGoroutine: runtime.NumGoroutine(),
+		NumTunnel:    len(a.tunnels.List()),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		Sys:          m.Sys,
+		NumGC:        m.NumGC,
+		PauseTotalNs: m.PauseTotalNs,
+	})
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// listenAdmin listens on a TCP address, or a unix socket like `unix:/run/weisuo.sock`
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, adminUnixPrefix) {
+		return listenAdminUnix(strings.TrimPrefix(addr, adminUnixPrefix))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenAdminUnix listens on the socket in a directory of 0700 first, and moves it to path once it's 0600,
+// so that it's never accessible by others
+func listenAdminUnix(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".weisuo-admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is moved, and removed only before listening next time
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, 0600)
+	if err == nil {
+		_ = os.Remove(path)
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func runAdmin(tunnels *protocol.Tunnels, bans *serverhelper.BanList) {
+	l, err := listenAdmin(cfg.AdminListen)
+	if err != nil {
+		log.Fatalf("admin listen failure: %v", err)
+	}
+	go func() {
+		err := http.Serve(l, newAdminHandler(cfg.AdminKey, tunnels, bans))
+		log.Fatalf("admin serve failure: %v", err)
+	}()
+}
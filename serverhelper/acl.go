@@ -0,0 +1,232 @@
+package serverhelper
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	aclActionAllow = "allow"
+	aclActionDeny  = "deny"
+
+	// aclPrivate can be used in cidr of rules, it expands to aclPrivateNetStrings
+	aclPrivate = "private"
+)
+
+var aclPrivateNetStrings = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// ACLRule matches a target if all of the specified conditions are met
+type ACLRule struct {
+	Action string `json:"action"`
+	// CIDR matches resolved ip addresses of targets
+	CIDR []string `json:"cidr"`
+	// Domains matches the domain and its subdomains
+	Domains []string `json:"domains"`
+	// Ports, e.g. `443` or `8000-9000`
+	Ports []string `json:"ports"`
+}
+
+type ACLConfig struct {
+	Default string                `json:"default"`
+	Rules   []*ACLRule            `json:"rules"`
+	Users   map[string][]*ACLRule `json:"users"`
+}
+
+type aclPortRange struct {
+	from, to int
+}
+
+type aclRule struct {
+	allow   bool
+	nets    []*net.IPNet
+	domains []string
+	ports   []aclPortRange
+}
+
+// ACL checks targets with rules of the user first, then global rules.
+// The first matched rule wins, the default action is applied if no rule matches.
+type ACL struct {
+	defaultAllow bool
+	rules        []*aclRule
+	users        map[string][]*aclRule
+}
+
+func NewACL(c *ACLConfig) (*ACL, error) {
+	a := &ACL{
+		users: make(map[string][]*aclRule),
+	}
+
+	switch c.Default {
+	case "", aclActionAllow:
+		a.defaultAllow = true
+	case aclActionDeny:
+	default:
+		return nil, fmt.Errorf("invalid default action: %s", c.Default)
+	}
+
+	var err error
+	a.rules, err = parseACLRules(c.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for user, rules := range c.Users {
+		a.users[user], err = parseACLRules(rules)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", user, err)
+		}
+	}
+
+	return a, nil
+}
+
+func parseACLRules(rules []*ACLRule) ([]*aclRule, error) {
+	var result []*aclRule
+	for i, r := range rules {
+		rule, err := parseACLRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func parseACLRule(r *ACLRule) (*aclRule, error) {
+	rule := &aclRule{}
+
+	switch r.Action {
+	case aclActionAllow:
+		rule.allow = true
+	case aclActionDeny:
+	default:
+		return nil, fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	for _, str := range r.CIDR {
+		strs := []string{str}
+		if str == aclPrivate {
+			strs = aclPrivateNetStrings
+		}
+		for _, s := range strs {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr: %s", s)
+			}
+			rule.nets = append(rule.nets, n)
+		}
+	}
+
+	for _, d := range r.Domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if d == "" {
+			return nil, fmt.Errorf("empty domain")
+		}
+		rule.domains = append(rule.domains, d)
+	}
+
+	for _, p := range r.Ports {
+		pr, err := parseACLPortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		rule.ports = append(rule.ports, pr)
+	}
+
+	return rule, nil
+}
+
+func parseACLPortRange(s string) (aclPortRange, error) {
+	from, to := s, s
+	if dashPos := strings.Index(s, "-"); dashPos >= 0 {
+		from, to = s[:dashPos], s[dashPos+1:]
+	}
+
+	f, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return aclPortRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	t, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return aclPortRange{}, fmt.Errorf("invalid port: %s", s)
+	}
+	if f < 0 || t > 65535 || f > t {
+		return aclPortRange{}, fmt.Errorf("invalid port range: %s", s)
+	}
+	return aclPortRange{from: f, to: t}, nil
+}
+
+func (r *aclRule) match(host string, ip net.IP, port int) bool {
+	if len(r.nets) > 0 {
+		matched := false
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.domains) > 0 {
+		matched := false
+		if net.ParseIP(host) == nil {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			for _, d := range r.domains {
+				if host == d || strings.HasSuffix(host, "."+d) {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 {
+		matched := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Allow checks a target, host is the requested host, ip is one of its resolved addresses
+func (a *ACL) Allow(user, host string, ip net.IP, port int) bool {
+	for _, r := range a.users[user] {
+		if r.match(host, ip, port) {
+			return r.allow
+		}
+	}
+	for _, r := range a.rules {
+		if r.match(host, ip, port) {
+			return r.allow
+		}
+	}
+	return a.defaultAllow
+}
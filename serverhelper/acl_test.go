@@ -0,0 +1,77 @@
+package serverhelper
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL(&ACLConfig{
+		Default: "allow",
+		Rules: []*ACLRule{
+			{Action: "deny", CIDR: []string{"private", "169.254.169.254/32"}},
+			{Action: "deny", Domains: []string{"blocked.com"}},
+			{Action: "deny", Ports: []string{"25", "6000-7000"}},
+		},
+		Users: map[string][]*ACLRule{
+			"alice": {
+				{Action: "allow", CIDR: []string{"192.168.1.0/24"}, Ports: []string{"22"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("new acl failure: %v", err)
+	}
+
+	for _, c := range []struct {
+		user  string
+		host  string
+		ip    string
+		port  int
+		allow bool
+	}{
+		{"", "example.com", "93.184.216.34", 443, true},
+		{"", "127.0.0.1", "127.0.0.1", 80, false},
+		{"", "rebind.example.com", "10.0.0.1", 80, false},
+		{"", "metadata", "169.254.169.254", 80, false},
+		{"", "::1", "::1", 80, false},
+		{"", "blocked.com", "93.184.216.34", 443, false},
+		{"", "www.Blocked.com", "93.184.216.34", 443, false},
+		{"", "notblocked.com", "93.184.216.34", 443, true},
+		{"", "example.com", "93.184.216.34", 25, false},
+		{"", "example.com", "93.184.216.34", 6666, false},
+		{"alice", "192.168.1.1", "192.168.1.1", 22, true},
+		{"alice", "192.168.1.1", "192.168.1.1", 80, false},
+		{"bob", "192.168.1.1", "192.168.1.1", 22, false},
+	} {
+		ret := acl.Allow(c.user, c.host, net.ParseIP(c.ip), c.port)
+		if ret != c.allow {
+			t.Fatalf("unexpected result of %v: %v", c, ret)
+		}
+	}
+
+	acl, err = NewACL(&ACLConfig{
+		Default: "deny",
+		Rules: []*ACLRule{
+			{Action: "allow", Ports: []string{"80", "443"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("new acl failure: %v", err)
+	}
+	if acl.Allow("", "example.com", net.ParseIP("93.184.216.34"), 22) {
+		t.Fatalf("unexpected result of default action")
+	}
+
+	for _, r := range []*ACLRule{
+		{Action: "reject"},
+		{Action: "deny", CIDR: []string{"1.2.3.4"}},
+		{Action: "deny", Ports: []string{"70000"}},
+		{Action: "deny", Ports: []string{"443-80"}},
+	} {
+		_, err = NewACL(&ACLConfig{Rules: []*ACLRule{r}})
+		if err == nil {
+			t.Fatalf("invalid rule is accepted: %v", r)
+		}
+	}
+}
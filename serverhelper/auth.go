@@ -1,7 +1,25 @@
 package serverhelper
 
-func StaticKeyAuthenticator(key string) func(string, string) bool {
-	return func(remoteIp, auth string) bool {
-		return auth == key
+import (
+	"time"
+	"weisuo/token"
+)
+
+func StaticKeyAuthenticator(key string) func(string, string, string) (string, bool) {
+	return func(remoteIp, auth, target string) (string, bool) {
+		return "", auth == key
+	}
+}
+
+// HmacKeyAuthenticator accepts tokens signed by the key, see token.Sign
+func HmacKeyAuthenticator(key string, maxSkew time.Duration) func(string, string, string) (string, bool) {
+	return VerifierAuthenticator(token.NewVerifier(key, maxSkew, token.DefaultCacheSize))
+}
+
+// VerifierAuthenticator accepts tokens verified by v, which should be kept as long as the key is,
+// or tokens used before could be replayed
+func VerifierAuthenticator(v *token.Verifier) func(string, string, string) (string, bool) {
+	return func(remoteIp, auth, target string) (string, bool) {
+		return "", v.Verify(auth, target) == nil
 	}
 }
@@ -3,7 +3,6 @@ package serverhelper
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"strings"
@@ -183,23 +182,23 @@ func AwsCloudfrontInit() {
 			Timeout: time.Second * 10,
 		}
 
-		errStr := "WARN failed to get latest AWS Cloudfront ip, use predefined ones: %v"
+		errStr := "failed to get latest AWS Cloudfront ip, use predefined ones: %v"
 		httpResp, err := httpClient.Get(awsAddressRangeUrl)
 		if err != nil {
-			log.Printf(errStr, err)
+			logWarnf(errStr, err)
 			return
 		}
 		defer httpResp.Body.Close()
 
 		if httpResp.StatusCode != http.StatusOK {
-			log.Printf(errStr, fmt.Errorf("http %d", httpResp.StatusCode))
+			logWarnf(errStr, fmt.Errorf("http %d", httpResp.StatusCode))
 			return
 		}
 
 		var resp awsRespRoot
 		err = json.NewDecoder(httpResp.Body).Decode(&resp)
 		if err != nil {
-			log.Printf(errStr, err)
+			logWarnf(errStr, err)
 			return
 		}
 		var result []string
@@ -212,28 +211,28 @@ func AwsCloudfrontInit() {
 		for _, str := range result {
 			_, n, err := net.ParseCIDR(str)
 			if err != nil {
-				log.Printf("WARN cannot parse CIDR, ignored: %s %v", str, err)
+				logWarnf("cannot parse CIDR, ignored: %s %v", str, err)
 				continue
 			}
 			awsNets = append(awsNets, n)
 		}
 		if len(awsNets) == 0 {
-			log.Printf(errStr, fmt.Errorf("empty result"))
+			logWarnf(errStr, fmt.Errorf("empty result"))
 			return
 		}
 
-		log.Printf("INFO get latest AWS Cloudfront ip successfully")
+		logInfof("get latest AWS Cloudfront ip successfully")
 		awsUpdated = true
 	})
 }
 
 func awsInitOffline() {
-	log.Printf("WARN online updating is disabled")
+	logWarnf("online updating is disabled")
 
 	for _, str := range awsNetStrings {
 		_, n, err := net.ParseCIDR(str)
 		if err != nil {
-			log.Printf("WARN cannot parse CIDR, ignored: %s %v", str, err)
+			logWarnf("cannot parse CIDR, ignored: %s %v", str, err)
 		} else {
 			awsNets = append(awsNets, n)
 		}
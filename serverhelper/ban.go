@@ -0,0 +1,232 @@
+package serverhelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ban is an entry of the ban list. Offenses are remembered for a while after the ban expires,
+// so that a source banned again is banned for longer.
+type Ban struct {
+	IP       string    `json:"ip"`
+	Until    time.Time `json:"until"`
+	Offenses int       `json:"offenses"`
+}
+
+// BanList bans source ips after too many authorization failures in a window.
+// The ban duration doubles with each offense, up to the max duration.
+type BanList struct {
+	path string
+
+	mutex       sync.Mutex
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+	// failures keeps times of recent failures of each ip
+	failures  map[string][]time.Time
+	bans      map[string]*Ban
+	lastPrune time.Time
+}
+
+// NewBanList returns a ban list saved to path, which is loaded if exists. It's not saved if path is empty.
+func NewBanList(path string) (*BanList, error) {
+	b := &BanList{
+		path:      path,
+		failures:  make(map[string][]time.Time),
+		bans:      make(map[string]*Ban),
+		lastPrune: time.Now(),
+	}
+	if path == "" {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read ban file failure: %v", err)
+	}
+	var list []*Ban
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("parse ban file failure: %v", err)
+	}
+	for _, ban := range list {
+		b.bans[ban.IP] = ban
+	}
+	return b, nil
+}
+
+// SetPolicy bans an ip for duration after maxFailures failures in window, zero maxFailures disables banning.
+// maxDuration is at least duration.
+func (b *BanList) SetPolicy(maxFailures int, window, duration, maxDuration time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.maxFailures = maxFailures
+	b.window = window
+	b.duration = duration
+	b.maxDuration = maxDuration
+	if b.maxDuration < b.duration {
+		b.maxDuration = b.duration
+	}
+}
+
+func (b *BanList) Banned(ip string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.banned(ip, time.Now())
+}
+
+// banned returns whether the ip is banned, b.mutex must be held
+func (b *BanList) banned(ip string, now time.Time) bool {
+	if b.maxFailures <= 0 {
+		return false
+	}
+	ban := b.bans[ip]
+	return ban != nil && now.Before(ban.Until)
+}
+
+// Failure records an authorization failure of the ip, returns whether it's banned by the failure
+func (b *BanList) Failure(ip string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.maxFailures <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	b.prune(now)
+
+	failures := b.failures[ip]
+	for len(failures) > 0 && now.Sub(failures[0]) > b.window {
+		failures = failures[1:]
+	}
+	failures = append(failures, now)
+	if len(failures) < b.maxFailures {
+		b.failures[ip] = failures
+		return false
+	}
+	delete(b.failures, ip)
+
+	ban := b.bans[ip]
+	if ban == nil {
+		ban = &Ban{IP: ip}
+		b.bans[ip] = ban
+	}
+	ban.Offenses++
+	d := b.duration
+	for i := 1; i < ban.Offenses && d < b.maxDuration; i++ {
+		d *= 2
+	}
+	if d > b.maxDuration {
+		d = b.maxDuration
+	}
+	ban.Until = now.Add(d)
+	b.save()
+	logWarnf("banned %s for %v, offense %d", ip, d, ban.Offenses)
+	return true
+}
+
+// Success forgets failures of the ip
+func (b *BanList) Success(ip string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.failures, ip)
+}
+
+// Unban removes the ban of the ip and its offenses, returns false if it's not banned
+func (b *BanList) Unban(ip string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ban := b.bans[ip]
+	if ban == nil {
+		return false
+	}
+	active := time.Now().Before(ban.Until)
+	delete(b.bans, ip)
+	delete(b.failures, ip)
+	b.save()
+	return active
+}
+
+// List returns active bans, sorted by ip
+func (b *BanList) List() []Ban {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	list := make([]Ban, 0)
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			list = append(list, *ban)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
+
+// prune removes stale failures, and offenses expired for maxDuration, b.mutex must be held
+func (b *BanList) prune(now time.Time) {
+	if now.Sub(b.lastPrune) < b.window {
+		return
+	}
+	b.lastPrune = now
+	for ip, failures := range b.failures {
+		if now.Sub(failures[len(failures)-1]) > b.window {
+			delete(b.failures, ip)
+		}
+	}
+	for ip, ban := range b.bans {
+		if now.Sub(ban.Until) > b.maxDuration {
+			delete(b.bans, ip)
+		}
+	}
+}
+
+// save writes bans to the file, b.mutex must be held
+func (b *BanList) save() {
+	if b.path == "" {
+		return
+	}
+	list := make([]*Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		list = append(list, ban)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		logWarnf("save ban file failure: %v", err)
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(b.path), "."+filepath.Base(b.path)+".tmp")
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, b.path)
+	}
+	if err != nil {
+		logWarnf("save ban file failure: %v", err)
+	}
+}
+
+// Authenticator wraps next, banned ips are rejected without calling next
+func (b *BanList) Authenticator(next func(string, string, string) (string, bool)) func(string, string, string) (string, bool) {
+	return func(remoteIp, auth, target string) (string, bool) {
+		if b.Banned(remoteIp) {
+			return "", false
+		}
+		user, ok := next(remoteIp, auth, target)
+		if ok {
+			b.Success(remoteIp)
+		} else {
+			b.Failure(remoteIp)
+		}
+		return user, ok
+	}
+}
@@ -0,0 +1,78 @@
+package serverhelper
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	b, err := NewBanList(path)
+	if err != nil {
+		t.Fatalf("new ban list failure: %v", err)
+	}
+	b.SetPolicy(3, time.Minute, 100*time.Millisecond, 300*time.Millisecond)
+
+	auth := b.Authenticator(StaticKeyAuthenticator("12345"))
+	for i := 0; i < 3; i++ {
+		if _, ok := auth("1.2.3.4", "wrong", ""); ok {
+			t.Fatalf("wrong key accepted")
+		}
+	}
+	if _, ok := auth("1.2.3.4", "12345", ""); ok {
+		t.Fatalf("banned ip accepted")
+	}
+	if _, ok := auth("5.6.7.8", "12345", ""); !ok {
+		t.Fatalf("other ip rejected")
+	}
+	if list := b.List(); len(list) != 1 || list[0].IP != "1.2.3.4" || list[0].Offenses != 1 {
+		t.Fatalf("unexpected bans: %v", list)
+	}
+
+	// persisted
+	b2, err := NewBanList(path)
+	if err != nil {
+		t.Fatalf("load ban list failure: %v", err)
+	}
+	b2.SetPolicy(3, time.Minute, 100*time.Millisecond, 300*time.Millisecond)
+	if !b2.Banned("1.2.3.4") {
+		t.Fatalf("ban not loaded")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, ok := auth("1.2.3.4", "12345", ""); !ok {
+		t.Fatalf("ban not expired")
+	}
+
+	// banned for longer on the second offense
+	for i := 0; i < 3; i++ {
+		b.Failure("1.2.3.4")
+	}
+	list := b.List()
+	if len(list) != 1 || list[0].Offenses != 2 || time.Until(list[0].Until) < 150*time.Millisecond {
+		t.Fatalf("unexpected bans: %v", list)
+	}
+
+	if !b.Unban("1.2.3.4") || b.Banned("1.2.3.4") {
+		t.Fatalf("unban failure")
+	}
+	if b.Unban("1.2.3.4") {
+		t.Fatalf("unban twice")
+	}
+
+	// an expired ban is removed but not reported as lifted
+	for i := 0; i < 3; i++ {
+		b.Failure("5.6.7.8")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if b.Unban("5.6.7.8") {
+		t.Fatalf("expired ban reported as lifted")
+	}
+	if b.Failure("5.6.7.8") || b.Failure("5.6.7.8") || !b.Failure("5.6.7.8") {
+		t.Fatalf("offenses not reset")
+	}
+	if list := b.List(); len(list) != 1 || list[0].Offenses != 1 {
+		t.Fatalf("unexpected bans: %v", list)
+	}
+}
@@ -3,7 +3,6 @@ package serverhelper
 import (
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"strings"
@@ -56,22 +55,22 @@ func CloudflareInit() {
 			Timeout: time.Second * 10,
 		}
 
-		errStr := "WARN failed to get latest cloudflare ip, use predefined ones: %v"
+		errStr := "failed to get latest cloudflare ip, use predefined ones: %v"
 		httpResp, err := httpClient.Get(cloudflareAddressRangeUrl)
 		if err != nil {
-			log.Printf(errStr, err)
+			logWarnf(errStr, err)
 			return
 		}
 		defer httpResp.Body.Close()
 
 		if httpResp.StatusCode != http.StatusOK {
-			log.Printf(errStr, fmt.Errorf("http %d", httpResp.StatusCode))
+			logWarnf(errStr, fmt.Errorf("http %d", httpResp.StatusCode))
 			return
 		}
 
 		respBytes, err := io.ReadAll(httpResp.Body)
 		if err != nil {
-			log.Printf(errStr, err)
+			logWarnf(errStr, err)
 			return
 		}
 
@@ -85,28 +84,28 @@ func CloudflareInit() {
 		for _, str := range result {
 			_, n, err := net.ParseCIDR(str)
 			if err != nil {
-				log.Printf("WARN cannot parse CIDR, ignored: %s %v", str, err)
+				logWarnf("cannot parse CIDR, ignored: %s %v", str, err)
 				continue
 			}
 			cloudflareNets = append(cloudflareNets, n)
 		}
 		if len(cloudflareNets) == 0 {
-			log.Printf(errStr, fmt.Errorf("empty result"))
+			logWarnf(errStr, fmt.Errorf("empty result"))
 			return
 		}
 
-		log.Printf("INFO get latest cloudflare ip successfully")
+		logInfof("get latest cloudflare ip successfully")
 		cloudflareUpdated = true
 	})
 }
 
 func cloudflareInitOffline() {
-	log.Printf("WARN online updating is disabled")
+	logWarnf("online updating is disabled")
 
 	for _, str := range cloudflareNetStrings {
 		_, n, err := net.ParseCIDR(str)
 		if err != nil {
-			log.Printf("WARN cannot parse CIDR, ignored: %s %v", str, err)
+			logWarnf("cannot parse CIDR, ignored: %s %v", str, err)
 		} else {
 			cloudflareNets = append(cloudflareNets, n)
 		}
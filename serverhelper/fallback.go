@@ -0,0 +1,48 @@
+package serverhelper
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// FallbackDir serves files in dir, so that the server looks like an ordinary static website
+func FallbackDir(dir string) (http.Handler, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback dir: %v", err)
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("invalid fallback dir: %s is not a directory", dir)
+	}
+	return http.FileServer(http.Dir(dir)), nil
+}
+
+// FallbackUpstream proxies requests to the upstream, so that the server looks like the upstream website.
+// Headers of the proxy protocol are not forwarded.
+func FallbackUpstream(upstream string) (http.Handler, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback upstream: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("invalid fallback upstream: it should be like https://example.com")
+	}
+
+	p := httputil.NewSingleHostReverseProxy(u)
+	director := p.Director
+	p.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Proxy-") {
+				r.Header.Del(k)
+			}
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,63 @@
+package serverhelper
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFallbackDir(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("write failure: %v", err)
+	}
+
+	h, err := FallbackDir(dir)
+	if err != nil {
+		t.Fatalf("fallback dir failure: %v", err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	_, err = FallbackDir(filepath.Join(dir, "index.html"))
+	if err == nil {
+		t.Fatalf("file accepted as dir")
+	}
+}
+
+func TestFallbackUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-PROXY-Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, "upstream "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	h, err := FallbackUpstream(upstream.URL)
+	if err != nil {
+		t.Fatalf("fallback upstream failure: %v", err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/about", nil)
+	r.Header.Set("X-PROXY-Authorization", "12345")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "upstream /about" {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, u := range []string{"ftp://example.com", "example.com", "https://"} {
+		_, err = FallbackUpstream(u)
+		if err == nil {
+			t.Errorf("invalid upstream accepted: %s", u)
+		}
+	}
+}
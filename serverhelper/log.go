@@ -0,0 +1,37 @@
+package serverhelper
+
+import (
+	"fmt"
+	"sync/atomic"
+	"weisuo/logger"
+)
+
+type pkgLogger struct {
+	l     logger.Logger
+	level logger.LogLevel
+}
+
+var currentLogger atomic.Value // *pkgLogger
+
+func init() {
+	SetLogger(&logger.DefaultLogger{}, logger.LogLevelInfo)
+}
+
+// SetLogger sets the logger of the package
+func SetLogger(l logger.Logger, level logger.LogLevel) {
+	currentLogger.Store(&pkgLogger{l: l, level: level})
+}
+
+func logf(level logger.LogLevel, format string, a ...interface{}) {
+	pl := currentLogger.Load().(*pkgLogger)
+	if pl.l != nil && pl.level >= level {
+		logger.Write(pl.l, level, fmt.Sprintf(format, a...))
+	}
+}
+
+func logInfof(format string, a ...interface{}) {
+	logf(logger.LogLevelInfo, format, a...)
+}
+func logWarnf(format string, a ...interface{}) {
+	logf(logger.LogLevelWarn, format, a...)
+}
@@ -0,0 +1,279 @@
+package serverhelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	UsageDayFormat   = "2006-01-02"
+	UsageMonthFormat = "2006-01"
+
+	// usageKeepDays is how long daily usage is kept
+	usageKeepDays = 62
+)
+
+// Usage is bytes transferred, sent is from the server to the client
+type Usage struct {
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+func (u Usage) Bytes() int64 {
+	return u.Sent + u.Received
+}
+
+// UserUsage is usage of a user in total, and by day and month in local time
+type UserUsage struct {
+	Total  Usage             `json:"total"`
+	Days   map[string]*Usage `json:"days"`
+	Months map[string]*Usage `json:"months"`
+}
+
+func (u *UserUsage) add(now time.Time, sent, received int64) {
+	u.Total.Sent += sent
+	u.Total.Received += received
+	for _, m := range []struct {
+		periods map[string]*Usage
+		key     string
+	}{
+		{u.Days, now.Format(UsageDayFormat)},
+		{u.Months, now.Format(UsageMonthFormat)},
+	} {
+		p := m.periods[m.key]
+		if p == nil {
+			p = &Usage{}
+			m.periods[m.key] = p
+		}
+		p.Sent += sent
+		p.Received += received
+	}
+}
+
+// Period returns usage of the day or month of t
+func (u *UserUsage) Period(t time.Time) (day Usage, month Usage) {
+	if d := u.Days[t.Format(UsageDayFormat)]; d != nil {
+		day = *d
+	}
+	if m := u.Months[t.Format(UsageMonthFormat)]; m != nil {
+		month = *m
+	}
+	return
+}
+
+func (u *UserUsage) clone() *UserUsage {
+	c := &UserUsage{
+		Total:  u.Total,
+		Days:   make(map[string]*Usage, len(u.Days)),
+		Months: make(map[string]*Usage, len(u.Months)),
+	}
+	for k, v := range u.Days {
+		d := *v
+		c.Days[k] = &d
+	}
+	for k, v := range u.Months {
+		m := *v
+		c.Months[k] = &m
+	}
+	return c
+}
+
+// QuotaLimits are limits of usage in MB, zero means unlimited
+type QuotaLimits struct {
+	Daily   uint64 `json:"daily"`
+	Monthly uint64 `json:"monthly"`
+	Total   uint64 `json:"total"`
+}
+
+// QuotaConfig is the quota of users, which may be overridden for each user
+type QuotaConfig struct {
+	QuotaLimits
+	// CutActive closes active tunnels of users out of quota
+	CutActive bool                    `json:"cut_active"`
+	Users     map[string]*QuotaLimits `json:"users"`
+}
+
+// Limits returns limits of the user
+func (c *QuotaConfig) Limits(user string) QuotaLimits {
+	if l, ok := c.Users[user]; ok && l != nil {
+		return *l
+	}
+	return c.QuotaLimits
+}
+
+// UsageStore counts traffic of users, which is saved to a JSON file
+type UsageStore struct {
+	path string
+
+	mutex sync.Mutex
+	users map[string]*UserUsage
+	dirty bool
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// LoadUsageStore loads usage from path if it exists
+func LoadUsageStore(path string) (*UsageStore, error) {
+	s := &UsageStore{
+		path:   path,
+		users:  make(map[string]*UserUsage),
+		stopCh: make(chan struct{}),
+	}
+	users, err := ReadUsageFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		s.users = users
+	}
+	return s, nil
+}
+
+// ReadUsageFile reads usage saved by a UsageStore
+func ReadUsageFile(path string) (map[string]*UserUsage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]*UserUsage
+	err = json.Unmarshal(data, &users)
+	if err != nil {
+		return nil, fmt.Errorf("parse usage file failure: %v", err)
+	}
+	for _, u := range users {
+		if u.Days == nil {
+			u.Days = make(map[string]*Usage)
+		}
+		if u.Months == nil {
+			u.Months = make(map[string]*Usage)
+		}
+	}
+	return users, nil
+}
+
+func (s *UsageStore) Add(user string, sent, received int64) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u := s.users[user]
+	if u == nil {
+		u = &UserUsage{
+			Days:   make(map[string]*Usage),
+			Months: make(map[string]*Usage),
+		}
+		s.users[user] = u
+	}
+	u.add(now, sent, received)
+	s.dirty = true
+}
+
+// Exceeded returns whether usage of the user has reached any of the limits
+func (s *UsageStore) Exceeded(user string, limits QuotaLimits) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u := s.users[user]
+	if u == nil {
+		return false
+	}
+	day, month := u.Period(time.Now())
+	for _, c := range []struct {
+		limit uint64
+		usage Usage
+	}{
+		{limits.Daily, day},
+		{limits.Monthly, month},
+		{limits.Total, u.Total},
+	} {
+		if c.limit > 0 && c.usage.Bytes() >= int64(c.limit)*1024*1024 {
+			return true
+		}
+	}
+	return false
+}
+
+// Users returns names of users with usage, sorted
+func (s *UsageStore) Users() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users := make([]string, 0, len(s.users))
+	for user := range s.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Get returns a copy of usage of the user
+func (s *UsageStore) Get(user string) (*UserUsage, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u := s.users[user]
+	if u == nil {
+		return nil, false
+	}
+	return u.clone(), true
+}
+
+// Save writes usage to the file if changed, daily usage older than usageKeepDays is removed
+func (s *UsageStore) Save() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.dirty {
+		return nil
+	}
+
+	oldest := time.Now().AddDate(0, 0, -usageKeepDays).Format(UsageDayFormat)
+	for _, u := range s.users {
+		for day := range u.Days {
+			if day < oldest {
+				delete(u.Days, day)
+			}
+		}
+	}
+
+	data, err := json.Marshal(s.users)
+	if err != nil {
+		return fmt.Errorf("save usage file failure: %v", err)
+	}
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("save usage file failure: %v", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// Run saves usage periodically until Stop
+func (s *UsageStore) Run(interval time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+			case <-s.stopCh:
+				return
+			}
+			err := s.Save()
+			if err != nil {
+				logWarnf("%v", err)
+			}
+		}
+	}()
+}
+
+// Stop stops saving periodically, and saves for the last time
+func (s *UsageStore) Stop() error {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	return s.Save()
+}
@@ -0,0 +1,52 @@
+package serverhelper
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	s, err := LoadUsageStore(path)
+	if err != nil {
+		t.Fatalf("load usage failure: %v", err)
+	}
+
+	s.Add("alice", 1024*1024, 0)
+	s.Add("alice", 0, 1024*1024)
+	s.Add("bob", 10, 20)
+
+	q := &QuotaConfig{
+		QuotaLimits: QuotaLimits{Daily: 2},
+		Users: map[string]*QuotaLimits{
+			"bob": {},
+		},
+	}
+	if !s.Exceeded("alice", q.Limits("alice")) {
+		t.Fatalf("alice not exceeded")
+	}
+	if s.Exceeded("bob", q.Limits("bob")) || s.Exceeded("carol", q.Limits("carol")) {
+		t.Fatalf("unexpected exceeded")
+	}
+	if s.Exceeded("alice", QuotaLimits{Monthly: 3}) {
+		t.Fatalf("unexpected exceeded of monthly quota")
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("save failure: %v", err)
+	}
+	s2, err := LoadUsageStore(path)
+	if err != nil {
+		t.Fatalf("load usage failure: %v", err)
+	}
+	if users := s2.Users(); len(users) != 2 || users[0] != "alice" || users[1] != "bob" {
+		t.Fatalf("unexpected users: %v", users)
+	}
+	u, _ := s2.Get("bob")
+	day, month := u.Period(time.Now())
+	if u.Total != (Usage{Sent: 10, Received: 20}) || day != u.Total || month != u.Total {
+		t.Fatalf("unexpected usage: %+v %+v %+v", u.Total, day, month)
+	}
+}
@@ -0,0 +1,233 @@
+package serverhelper
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const usersVerifiedCacheSize = 10000
+
+// User is an entry of the users file, the key is hashed by bcrypt
+type User struct {
+	Name    string     `json:"name"`
+	KeyHash string     `json:"key_hash"`
+	Enabled *bool      `json:"enabled,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (u *User) isValid(now time.Time) bool {
+	if u.Enabled != nil && !*u.Enabled {
+		return false
+	}
+	if u.Expires != nil && now.After(*u.Expires) {
+		return false
+	}
+	return true
+}
+
+// UserStore keeps users loaded from a JSON file.
+// Clients authorize with `name:key`.
+type UserStore struct {
+	path string
+
+	mutex   sync.RWMutex
+	users   map[string]*User
+	modTime time.Time
+	// generation is increased on each reload
+	generation uint64
+	// verified caches results of bcrypt, sha256 of auth string => user name
+	verified map[[sha256.Size]byte]string
+	// dummyHash is compared for unknown users, so that they take as long as known ones
+	dummyHash []byte
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func LoadUserStore(path string) (*UserStore, error) {
+	s := &UserStore{
+		path:   path,
+		stopCh: make(chan struct{}),
+	}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *UserStore) Reload() error {
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("stat users file failure: %v", err)
+	}
+	users, err := readUsersFile(s.path)
+	if err != nil {
+		return err
+	}
+	dummyHash, err := makeDummyHash(users)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.users = users
+	s.modTime = stat.ModTime()
+	s.generation++
+	s.verified = make(map[[sha256.Size]byte]string)
+	s.dummyHash = dummyHash
+	return nil
+}
+
+// makeDummyHash hashes a random key by the highest cost of users
+func makeDummyHash(users map[string]*User) ([]byte, error) {
+	cost := bcrypt.DefaultCost
+	if len(users) > 0 {
+		cost = bcrypt.MinCost
+	}
+	for _, u := range users {
+		c, _ := bcrypt.Cost([]byte(u.KeyHash))
+		if c > cost {
+			cost = c
+		}
+	}
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("generate dummy key failure: %v", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword(key, cost)
+	if err != nil {
+		return nil, fmt.Errorf("hash dummy key failure: %v", err)
+	}
+	return hash, nil
+}
+
+func readUsersFile(path string) (map[string]*User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open users file failure: %v", err)
+	}
+	defer f.Close()
+
+	var list []*User
+	err = json.NewDecoder(f).Decode(&list)
+	if err != nil {
+		return nil, fmt.Errorf("parse users file failure: %v", err)
+	}
+
+	users := make(map[string]*User)
+	for _, u := range list {
+		if u.Name == "" || strings.Contains(u.Name, ":") {
+			return nil, fmt.Errorf("invalid user name: `%s`", u.Name)
+		}
+		if _, ok := users[u.Name]; ok {
+			return nil, fmt.Errorf("duplicated user: %s", u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.KeyHash)); err != nil {
+			return nil, fmt.Errorf("invalid key hash of user %s: %v", u.Name, err)
+		}
+		users[u.Name] = u
+	}
+	return users, nil
+}
+
+// Watch reloads the users file once it's modified
+func (s *UserStore) Watch(interval time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+			case <-s.stopCh:
+				return
+			}
+
+			stat, err := os.Stat(s.path)
+			if err != nil {
+				logWarnf("cannot stat users file: %v", err)
+				continue
+			}
+
+			s.mutex.RLock()
+			modified := !stat.ModTime().Equal(s.modTime)
+			s.mutex.RUnlock()
+			if !modified {
+				continue
+			}
+
+			err = s.Reload()
+			if err != nil {
+				logWarnf("reload users file failure, keep the old ones: %v", err)
+				continue
+			}
+			logInfof("users file reloaded")
+		}
+	}()
+}
+
+// Stop stops watching the users file
+func (s *UserStore) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+func (s *UserStore) Path() string {
+	return s.path
+}
+
+// Authenticate verifies auth, unknown users take as long as known ones
+func (s *UserStore) Authenticate(auth string) (string, bool) {
+	colonPos := strings.Index(auth, ":")
+	if colonPos <= 0 {
+		return "", false
+	}
+	name, key := auth[:colonPos], auth[colonPos+1:]
+	sum := sha256.Sum256([]byte(auth))
+
+	s.mutex.RLock()
+	u := s.users[name]
+	verifiedName, verified := s.verified[sum]
+	generation := s.generation
+	dummyHash := s.dummyHash
+	s.mutex.RUnlock()
+
+	valid := u != nil && u.isValid(time.Now())
+	if valid && verified && verifiedName == name {
+		return name, true
+	}
+
+	hash := dummyHash
+	if u != nil {
+		hash = []byte(u.KeyHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(key)) != nil || !valid {
+		return "", false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.generation != generation {
+		// reloaded during bcrypt, do not cache the result of old ones
+		return name, true
+	}
+	if len(s.verified) >= usersVerifiedCacheSize {
+		s.verified = make(map[[sha256.Size]byte]string)
+	}
+	s.verified[sum] = name
+	return name, true
+}
+
+func (s *UserStore) Authenticator() func(string, string, string) (string, bool) {
+	return func(remoteIp, auth, target string) (string, bool) {
+		return s.Authenticate(auth)
+	}
+}
@@ -0,0 +1,74 @@
+package serverhelper
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeUsersFile(t *testing.T, path string, content string) {
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("write users file failure: %v", err)
+	}
+}
+
+func TestUserStore(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("12345"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt failure: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsersFile(t, path, fmt.Sprintf(`[
+		{"name": "alice", "key_hash": "%[1]s"},
+		{"name": "bob", "key_hash": "%[1]s", "enabled": false},
+		{"name": "carol", "key_hash": "%[1]s", "expires": "2000-01-01T00:00:00Z"}
+	]`, hash))
+
+	s, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatalf("load failure: %v", err)
+	}
+
+	for _, c := range []struct {
+		auth string
+		user string
+		ok   bool
+	}{
+		{"alice:12345", "alice", true},
+		{"alice:12345", "alice", true},
+		{"alice:11111", "", false},
+		{"12345", "", false},
+		{"bob:12345", "", false},
+		{"carol:12345", "", false},
+		{"dave:12345", "", false},
+	} {
+		user, ok := s.Authenticate(c.auth)
+		if user != c.user || ok != c.ok {
+			t.Fatalf("unexpected result of %s: %s %v", c.auth, user, ok)
+		}
+	}
+
+	writeUsersFile(t, path, fmt.Sprintf(`[{"name": "bob", "key_hash": "%s"}]`, hash))
+	err = s.Reload()
+	if err != nil {
+		t.Fatalf("reload failure: %v", err)
+	}
+	if _, ok := s.Authenticate("alice:12345"); ok {
+		t.Fatalf("removed user is still valid")
+	}
+	if user, ok := s.Authenticate("bob:12345"); !ok || user != "bob" {
+		t.Fatalf("unexpected result after reload: %s %v", user, ok)
+	}
+
+	writeUsersFile(t, path, `[{"name": "bob", "key_hash": "12345"}]`)
+	if s.Reload() == nil {
+		t.Fatalf("invalid key hash is accepted")
+	}
+	if _, ok := s.Authenticate("bob:12345"); !ok {
+		t.Fatalf("users are changed by failed reload")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync/atomic"
+	"weisuo/ratelimit"
+)
+
+// RateLimit is in KB/s, zero means unlimited. Upload is from clients to targets, download is from targets to clients.
+type RateLimit struct {
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// RateLimitConfig limits bandwidth of all tunnels, tunnels of each user, and each tunnel.
+// Limits of a user in Users replace the default ones of users.
+type RateLimitConfig struct {
+	Global RateLimit             `json:"global"`
+	User   RateLimit             `json:"user"`
+	Conn   RateLimit             `json:"conn"`
+	Users  map[string]*RateLimit `json:"users"`
+}
+
+// shaper keeps limiters across reloads
+type shaper struct {
+	globalUpload   *ratelimit.Limiter
+	globalDownload *ratelimit.Limiter
+	userUpload     *ratelimit.Group
+	userDownload   *ratelimit.Group
+	config         atomic.Value // *RateLimitConfig
+}
+
+var shaping = newShaper()
+
+func newShaper() *shaper {
+	s := &shaper{
+		globalUpload:   ratelimit.NewLimiter(0),
+		globalDownload: ratelimit.NewLimiter(0),
+		userUpload:     ratelimit.NewGroup(),
+		userDownload:   ratelimit.NewGroup(),
+	}
+	s.config.Store(&RateLimitConfig{})
+	return s
+}
+
+// apply applies rate_limit, nil means unlimited
+func (s *shaper) apply(c *RateLimitConfig) {
+	if c == nil {
+		c = &RateLimitConfig{}
+	}
+	s.globalUpload.SetRate(kbps(c.Global.Upload))
+	s.globalDownload.SetRate(kbps(c.Global.Download))
+	s.config.Store(c)
+}
+
+// limiters returns limiters of a new tunnel of the user, for upload and download
+func (s *shaper) limiters(user string) ([]*ratelimit.Limiter, []*ratelimit.Limiter) {
+	c := s.config.Load().(*RateLimitConfig)
+	userLimit := c.User
+	if l, ok := c.Users[user]; ok && l != nil {
+		userLimit = *l
+	}
+	upload := []*ratelimit.Limiter{s.globalUpload, s.userUpload.Get(user, kbps(userLimit.Upload))}
+	download := []*ratelimit.Limiter{s.globalDownload, s.userDownload.Get(user, kbps(userLimit.Download))}
+	if c.Conn.Upload > 0 {
+		upload = append(upload, ratelimit.NewLimiter(kbps(c.Conn.Upload)))
+	}
+	if c.Conn.Download > 0 {
+		download = append(download, ratelimit.NewLimiter(kbps(c.Conn.Download)))
+	}
+	return upload, download
+}
+
+func kbps(rate uint64) int64 {
+	return int64(rate) * 1024
+}
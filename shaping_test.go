@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestRateLimit(t *testing.T) {
+	s := newShaper()
+	s.apply(&RateLimitConfig{
+		Conn: RateLimit{Download: 100},
+	})
+
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.RateLimit = s.limiters
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10071", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10072")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		conn, err := dialer.Dial("ws://127.0.0.1:10071/proxy", "12345", "tcp", "127.0.0.1:10072")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+
+		start := time.Now()
+		data := make([]byte, 120*1024)
+		go conn.Write(data)
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		// 20 KB of burst, then 100 KB/s
+		if d := time.Since(start); d < 800*time.Millisecond || d > 1500*time.Millisecond {
+			t.Errorf("unexpected duration: %v", d)
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// waitForShutdown blocks until SIGTERM or SIGINT, and returns a context which is done at the drain deadline.
+// On SIGHUP, the config is reloaded and applied by apply. On SIGUSR1, the log file is reopened.
+func waitForShutdown(apply func(c *Config) error) (context.Context, context.CancelFunc) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+loop:
+	for sig := range ch {
+		switch sig {
+		case syscall.SIGHUP:
+			reload(apply)
+		case syscall.SIGUSR1:
+			reopenLogFile()
+		default:
+			break loop
+		}
+	}
+	signal.Stop(ch)
+
+	timeout := defaultDrainTimeout
+	if c := currentConfig(); c.DrainTimeout > 0 {
+		timeout = time.Duration(c.DrainTimeout) * time.Second
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// connTracker keeps connections of active requests of a client, so that they can be drained on shutdown.
+// Methods are no-op on nil.
+type connTracker struct {
+	mutex    sync.Mutex
+	conns    map[uint64][]io.Closer
+	nextId   uint64
+	draining bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[uint64][]io.Closer),
+	}
+}
+
+// add tracks connections of a request, returns the function to untrack them, or false if it's draining
+func (t *connTracker) add(conns ...io.Closer) (func(), bool) {
+	if t == nil {
+		return func() {}, true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.draining {
+		return nil, false
+	}
+	id := t.nextId
+	t.nextId++
+	t.conns[id] = conns
+	return func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		delete(t.conns, id)
+	}, true
+}
+
+// drain waits for requests to finish until ctx is done, then closes the rest and returns the number of them
+func (t *connTracker) drain(ctx context.Context) int {
+	if t == nil {
+		return 0
+	}
+	t.mutex.Lock()
+	t.draining = true
+	t.mutex.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		t.mutex.Lock()
+		n := len(t.conns)
+		t.mutex.Unlock()
+		if n == 0 {
+			return 0
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			for _, conns := range t.conns {
+				for _, c := range conns {
+					_ = c.Close()
+				}
+			}
+			return len(t.conns)
+		}
+	}
+}
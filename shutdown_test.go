@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+)
+
+func TestShutdown(t *testing.T) {
+	h := protocol.DefaultHandler()
+	h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+		return "", auth == "12345"
+	}
+	h.LogLevel = logger.LogLevelDebug
+	h.Tunnels = protocol.NewTunnels()
+
+	errCh := make(chan error)
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10087", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10097")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				t.Log("accept failure", err)
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	echo := func(conn protocol.TCPConn) error {
+		_, err := conn.Write([]byte("333"))
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+		if string(buf) != "333" {
+			return errors.New("client read data")
+		}
+		return nil
+	}
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		dialer.LogLevel = logger.LogLevelDebug
+
+		idleConn, err := dialer.DialIdle("ws://127.0.0.1:10087/proxy", "12345", nil)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		var conns []protocol.TCPConn
+		for i := 0; i < 2; i++ {
+			conn, err := dialer.Dial("ws://127.0.0.1:10087/proxy", "12345", "tcp", "127.0.0.1:10097")
+			if err != nil {
+				errCh <- err
+				return
+			}
+			conns = append(conns, conn)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownCh := make(chan int)
+		go func() {
+			shutdownCh <- h.Shutdown(ctx)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		_, err = idleConn.Dial("tcp", "127.0.0.1:10097")
+		if !errors.Is(err, protocol.ErrUseAnotherIdleConn) {
+			errCh <- fmt.Errorf("idle conn is not drained: %v", err)
+			return
+		}
+
+		_, err = dialer.Dial("ws://127.0.0.1:10087/proxy", "12345", "tcp", "127.0.0.1:10097")
+		if err == nil {
+			errCh <- errors.New("new request is accepted when draining")
+			return
+		}
+
+		// active tunnels keep working
+		for _, conn := range conns {
+			err = echo(conn)
+			if err != nil {
+				errCh <- fmt.Errorf("active tunnel: %v", err)
+				return
+			}
+		}
+		conns[0].Close()
+
+		select {
+		case n := <-shutdownCh:
+			if n != 1 {
+				errCh <- fmt.Errorf("unexpected number of tunnels closed forcibly: %d", n)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			errCh <- errors.New("shutdown timeout")
+			return
+		}
+
+		_ = conns[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conns[1].Read(make([]byte, 1))
+		var netErr net.Error
+		if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+			errCh <- errors.New("tunnel is not closed forcibly")
+			return
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+	"weisuo/logger"
+	"weisuo/pool"
+	"weisuo/protocol"
+)
+
+func TestSocks5(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.LogLevel = logger.LogLevelDebug
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10084", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10094")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				t.Log("accept failure", err)
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	dialer := protocol.DefaultDialer()
+	dialer.LogLevel = logger.LogLevelDebug
+	p := newClientPool(pool.MakePool("ws://127.0.0.1:10084/proxy", "12345", 0, dialer))
+
+	for addr, s := range map[string]*Socks5Server{
+		"127.0.0.1:10184": {pool: p, username: "user", password: "pass"},
+		"127.0.0.1:10185": {pool: p},
+	} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("listen failure 3: %v", err)
+		}
+		go func(s *Socks5Server) {
+			err := s.serve(l)
+			t.Log("accept failure", err)
+			errCh <- err
+		}(s)
+	}
+
+	time.Sleep(time.Second)
+
+	// request sends req, and checks the reply
+	request := func(addr string, req []byte, expect []byte) (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Write(req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		buf := make([]byte, len(expect))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if !bytes.Equal(buf, expect) {
+			conn.Close()
+			return nil, fmt.Errorf("unexpected reply: %v", buf)
+		}
+		return conn, nil
+	}
+
+	echo := func(conn net.Conn) error {
+		defer conn.Close()
+		_, err := conn.Write([]byte("333"))
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 3)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return err
+		}
+		if string(buf) != "333" {
+			return errors.New("client read data")
+		}
+		return nil
+	}
+
+	auth := []byte{5, 1, 2, 1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}
+	connectDomain := []byte{5, 1, 0, 3, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x27, 0x6e}
+	succeeded := []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	go func() {
+		// SOCKS5 with password, domain
+		conn, err := request("127.0.0.1:10184", append(append([]byte{}, auth...), connectDomain...), append([]byte{5, 2, 1, 0}, succeeded...))
+		if err != nil {
+			errCh <- fmt.Errorf("socks5: %v", err)
+			return
+		}
+		err = echo(conn)
+		if err != nil {
+			errCh <- fmt.Errorf("socks5: %v", err)
+			return
+		}
+
+		// SOCKS5 with wrong password
+		conn, err = request("127.0.0.1:10184", []byte{5, 1, 2, 1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 'x'}, []byte{5, 2, 1, 1})
+		if err != nil {
+			errCh <- fmt.Errorf("socks5 wrong password: %v", err)
+			return
+		}
+		conn.Close()
+
+		// SOCKS5 without password
+		conn, err = request("127.0.0.1:10184", []byte{5, 1, 0}, []byte{5, 0xff})
+		if err != nil {
+			errCh <- fmt.Errorf("socks5 without password: %v", err)
+			return
+		}
+		conn.Close()
+
+		// SOCKS5 connection refused
+		conn, err = request("127.0.0.1:10185", []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 1}, []byte{5, 0, 5, 5})
+		if err != nil {
+			errCh <- fmt.Errorf("socks5 refused: %v", err)
+			return
+		}
+		conn.Close()
+
+		// SOCKS4a
+		conn, err = request("127.0.0.1:10185", []byte{4, 1, 0x27, 0x6e, 0, 0, 0, 1, 0, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0}, []byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+		if err != nil {
+			errCh <- fmt.Errorf("socks4a: %v", err)
+			return
+		}
+		err = echo(conn)
+		if err != nil {
+			errCh <- fmt.Errorf("socks4a: %v", err)
+			return
+		}
+
+		// SOCKS4 is rejected if password is required
+		conn, err = request("127.0.0.1:10184", []byte{4, 1, 0x27, 0x6e, 127, 0, 0, 1, 0}, []byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+		if err != nil {
+			errCh <- fmt.Errorf("socks4: %v", err)
+			return
+		}
+		conn.Close()
+
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+	"weisuo/serverhelper"
+)
+
+const (
+	statsPeriodDay   = "day"
+	statsPeriodMonth = "month"
+)
+
+// runStats prints usage per user saved in usage_file, by `weisuo -config config.json stats`
+func runStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	period := fs.String("period", "", "list usage of each `day` or `month`, usage of today, this month and total by default")
+	_ = fs.Parse(args)
+
+	if cfg.UsageFile == "" {
+		log.Fatalf("usage_file is not specified")
+	}
+	users, err := serverhelper.ReadUsageFile(cfg.UsageFile)
+	if err != nil {
+		log.Fatalf("read usage file failure: %v", err)
+	}
+	switch *period {
+	case "", statsPeriodDay, statsPeriodMonth:
+	default:
+		log.Fatalf("invalid period: %s", *period)
+	}
+	printStats(os.Stdout, users, *period, time.Now())
+}
+
+func printStats(w io.Writer, users map[string]*serverhelper.UserUsage, period string, now time.Time) {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tPERIOD\tSENT\tRECEIVED\tTOTAL")
+	row := func(name, p string, u serverhelper.Usage) {
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, p, formatBytes(u.Sent), formatBytes(u.Received), formatBytes(u.Bytes()))
+	}
+	for _, name := range names {
+		u := users[name]
+		switch period {
+		case statsPeriodDay, statsPeriodMonth:
+			periods := u.Days
+			if period == statsPeriodMonth {
+				periods = u.Months
+			}
+			keys := make([]string, 0, len(periods))
+			for k := range periods {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				row(name, k, *periods[k])
+			}
+		default:
+			day, month := u.Period(now)
+			row(name, now.Format(serverhelper.UsageDayFormat), day)
+			row(name, now.Format(serverhelper.UsageMonthFormat), month)
+			row(name, "total", u.Total)
+		}
+	}
+	_ = tw.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit || suffix == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"weisuo/protocol"
+	"weisuo/serverhelper"
+)
+
+func TestQuota(t *testing.T) {
+	usage, err := serverhelper.LoadUsageStore(filepath.Join(t.TempDir(), "usage.json"))
+	if err != nil {
+		t.Fatalf("load usage failure: %v", err)
+	}
+	quota := &serverhelper.QuotaConfig{QuotaLimits: serverhelper.QuotaLimits{Daily: 1}}
+
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "alice", auth == "12345"
+		}
+		h.Accounting = usage.Add
+		h.Quota = func(user string) bool {
+			return !usage.Exceeded(user, quota.Limits(user))
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10189", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10199")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+		conn, err := dialer.Dial("ws://127.0.0.1:10189/proxy", "12345", "tcp", "127.0.0.1:10199")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		data := make([]byte, 512*1024)
+		go conn.Write(data)
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			conn.Close()
+			errCh <- err
+			return
+		}
+
+		// usage of a tunnel is flushed periodically, while it's still open and idle
+		time.Sleep(1500 * time.Millisecond)
+		u, ok := usage.Get("alice")
+		if !ok || u.Total.Sent != 512*1024 || u.Total.Received != 512*1024 {
+			t.Errorf("unexpected usage: %+v", u)
+		}
+		conn.Close()
+
+		_, err = dialer.Dial("ws://127.0.0.1:10189/proxy", "12345", "tcp", "127.0.0.1:10199")
+		if protocol.ErrorCode(err) != protocol.ErrorCodeQuotaExceeded {
+			t.Errorf("unexpected error: %v", err)
+		}
+		errCh <- nil
+	}()
+
+	err = <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
+
+func TestPrintStats(t *testing.T) {
+	now := time.Date(2023, 5, 1, 8, 0, 0, 0, time.Local)
+	users := map[string]*serverhelper.UserUsage{
+		"alice": {
+			Total:  serverhelper.Usage{Sent: 3 * 1024 * 1024, Received: 1024},
+			Days:   map[string]*serverhelper.Usage{"2023-05-01": {Sent: 1024 * 1024, Received: 512}},
+			Months: map[string]*serverhelper.Usage{"2023-05": {Sent: 2 * 1024 * 1024, Received: 512}},
+		},
+	}
+	var buf bytes.Buffer
+	printStats(&buf, users, "", now)
+	out := buf.String()
+	for _, expected := range []string{"alice  2023-05-01  1.0 MiB", "alice  2023-05     2.0 MiB", "alice  total       3.0 MiB"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("%q not found in\n%s", expected, out)
+		}
+	}
+}
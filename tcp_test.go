@@ -16,8 +16,8 @@ func TestTcp(t *testing.T) {
 	errCh := make(chan error)
 	go func() {
 		h := protocol.DefaultHandler()
-		h.Authenticator = func(remoteIp, auth string) bool {
-			return auth == "12345"
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
 		}
 		h.LogLevel = logger.LogLevelDebug
 
@@ -168,8 +168,8 @@ func TestTcpIdle(t *testing.T) {
 	errCh := make(chan error)
 	go func() {
 		h := protocol.DefaultHandler()
-		h.Authenticator = func(remoteIp, auth string) bool {
-			return auth == "12345"
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
 		}
 		h.LogLevel = logger.LogLevelDebug
 
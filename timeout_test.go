@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"weisuo/protocol"
+)
+
+func TestTunnelTimeouts(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.Metrics = protocol.NewMetrics()
+		h.TunnelIdleTimeout = time.Second
+		h.TunnelMaxLifetime = 2 * time.Second
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		mux.Handle("/metrics", h.Metrics)
+		err := http.ListenAndServe("127.0.0.1:10075", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		l, err := net.Listen("tcp", "127.0.0.1:10076")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	go func() {
+		dialer := protocol.DefaultDialer()
+
+		// idle
+		conn, err := dialer.Dial("ws://127.0.0.1:10075/proxy", "12345", "tcp", "127.0.0.1:10076")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		start := time.Now()
+		_, err = io.Copy(io.Discard, conn)
+		conn.Close()
+		if d := time.Since(start); d < time.Second || d > 1500*time.Millisecond {
+			t.Errorf("unexpected idle duration: %v %v", d, err)
+		}
+
+		// active until the max lifetime
+		conn, err = dialer.Dial("ws://127.0.0.1:10075/proxy", "12345", "tcp", "127.0.0.1:10076")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		start = time.Now()
+		go func() {
+			for i := 0; i < 20; i++ {
+				_, err := conn.Write([]byte("333"))
+				if err != nil {
+					return
+				}
+				time.Sleep(200 * time.Millisecond)
+			}
+		}()
+		_, err = io.Copy(io.Discard, conn)
+		conn.Close()
+		if d := time.Since(start); d < 1500*time.Millisecond || d > 2500*time.Millisecond {
+			t.Errorf("unexpected lifetime: %v %v", d, err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		resp, err := http.Get("http://127.0.0.1:10075/metrics")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		for _, line := range []string{
+			`weisuo_tunnels_closed_total{reason="idle_timeout"} 1`,
+			`weisuo_tunnels_closed_total{reason="max_lifetime"} 1`,
+		} {
+			if !strings.Contains(string(body), line+"\n") {
+				errCh <- fmt.Errorf("metrics without %s:\n%s", line, body)
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	err := <-errCh
+	if err != nil {
+		t.Fatalf("failure: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token format: v1.<unix timestamp>.<nonce>.<hmac>
+// The hmac is HMAC-SHA256 of "v1.<unix timestamp>.<nonce>.<target>" with the key, in hex.
+const (
+	tokenVersion = "v1"
+	nonceSize    = 16
+
+	DefaultMaxSkew   = 30 * time.Second
+	DefaultCacheSize = 100000
+)
+
+var (
+	ErrMalformed = errors.New("malformed token")
+	ErrSignature = errors.New("invalid signature")
+	ErrExpired   = errors.New("timestamp out of window")
+	ErrReplayed  = errors.New("nonce replayed")
+	// ErrCacheFull is returned if the nonces in the window are too many to remember, the token may be valid.
+	// It's rejected, since it could not be told from a replayed one later.
+	ErrCacheFull = errors.New("nonce cache full")
+)
+
+// Sign generates a token for the target, a new nonce is used for each call.
+// The target is empty for idle and mux handshakes, so such tokens are not bound to any target.
+// They are accepted once as others, and the targets requested over the connection are checked by the server.
+func Sign(key, target string) string {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		panic(fmt.Sprintf("cannot generate nonce: %v", err))
+	}
+	return sign(key, target, time.Now(), hex.EncodeToString(nonce))
+}
+
+func sign(key, target string, t time.Time, nonce string) string {
+	payload := tokenVersion + "." + strconv.FormatInt(t.Unix(), 10) + "." + nonce
+	return payload + "." + mac(key, payload, target)
+}
+
+func mac(key, payload, target string) string {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(payload + "." + target))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Verifier verifies tokens signed by the key,
+// tokens are accepted only once, and only if the clock skew is in the window
+type Verifier struct {
+	key     string
+	maxSkew time.Duration
+	size    int
+
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+	queue  []string
+}
+
+func NewVerifier(key string, maxSkew time.Duration, cacheSize int) *Verifier {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	if cacheSize <= 0 {
+		cacheSize = DefaultCacheSize
+	}
+	return &Verifier{
+		key:     key,
+		maxSkew: maxSkew,
+		size:    cacheSize,
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+func (v *Verifier) Verify(token, target string) error {
+	return v.verify(token, target, time.Now())
+}
+
+func (v *Verifier) verify(token, target string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != tokenVersion || len(parts[2]) != nonceSize*2 {
+		return ErrMalformed
+	}
+
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	expected := mac(v.key, strings.Join(parts[:3], "."), target)
+	if !hmac.Equal([]byte(expected), []byte(parts[3])) {
+		return ErrSignature
+	}
+
+	t := time.Unix(ts, 0)
+	if t.Before(now.Add(-v.maxSkew)) || t.After(now.Add(v.maxSkew)) {
+		return ErrExpired
+	}
+
+	return v.useNonce(parts[2], t, now)
+}
+
+// useNonce records the nonce, fails if it's already used or the cache is full of nonces in the window
+func (v *Verifier) useNonce(nonce string, t time.Time, now time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if _, ok := v.nonces[nonce]; ok {
+		return ErrReplayed
+	}
+
+	// nonces out of the window are rejected by timestamp, no need to keep them
+	expired := func(nonce string) bool {
+		return v.nonces[nonce].Before(now.Add(-v.maxSkew))
+	}
+	for len(v.queue) > 0 && expired(v.queue[0]) {
+		delete(v.nonces, v.queue[0])
+		v.queue = v.queue[1:]
+	}
+	if len(v.queue) >= v.size {
+		// timestamps are not in order, expired ones may be after the oldest
+		queue := v.queue[:0]
+		for _, n := range v.queue {
+			if expired(n) {
+				delete(v.nonces, n)
+			} else {
+				queue = append(queue, n)
+			}
+		}
+		v.queue = queue
+	}
+	if len(v.queue) >= v.size {
+		return ErrCacheFull
+	}
+
+	v.nonces[nonce] = t
+	v.queue = append(v.queue, nonce)
+	return nil
+}
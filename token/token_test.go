@@ -0,0 +1,80 @@
+package token
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier("12345", 0, 0)
+
+	tk := Sign("12345", "a.com:443")
+	err := v.Verify(tk, "a.com:443")
+	if err != nil {
+		t.Fatalf("verify failure: %v", err)
+	}
+
+	err = v.Verify(tk, "a.com:443")
+	if err != ErrReplayed {
+		t.Fatalf("unexpected err of replayed token: %v", err)
+	}
+
+	err = v.Verify(Sign("12345", "a.com:443"), "b.com:443")
+	if err != ErrSignature {
+		t.Fatalf("unexpected err of another target: %v", err)
+	}
+
+	err = v.Verify(Sign("11111", "a.com:443"), "a.com:443")
+	if err != ErrSignature {
+		t.Fatalf("unexpected err of another key: %v", err)
+	}
+
+	err = v.Verify("12345", "a.com:443")
+	if err != ErrMalformed {
+		t.Fatalf("unexpected err of static key: %v", err)
+	}
+
+	old := sign("12345", "", time.Now().Add(-time.Minute), "00112233445566778899aabbccddeeff")
+	err = v.Verify(old, "")
+	if err != ErrExpired {
+		t.Fatalf("unexpected err of old token: %v", err)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	v := NewVerifier("12345", time.Minute, 2)
+	now := time.Now()
+
+	for _, nonce := range []string{
+		"00000000000000000000000000000001",
+		"00000000000000000000000000000002",
+	} {
+		err := v.verify(sign("12345", "", now, nonce), "", now)
+		if err != nil {
+			t.Fatalf("verify failure: %v", err)
+		}
+	}
+
+	// nonces in the window are kept, new tokens are rejected instead
+	err := v.verify(sign("12345", "", now, "00000000000000000000000000000003"), "", now)
+	if err != ErrCacheFull {
+		t.Fatalf("unexpected err of full cache: %v", err)
+	}
+	err = v.verify(sign("12345", "", now, "00000000000000000000000000000001"), "", now)
+	if err != ErrReplayed {
+		t.Fatalf("unexpected err of replayed token: %v", err)
+	}
+	if len(v.nonces) != 2 || len(v.queue) != 2 {
+		t.Fatalf("unexpected cache size: %d %d", len(v.nonces), len(v.queue))
+	}
+
+	// expired ones are evicted
+	later := now.Add(2 * time.Minute)
+	err = v.verify(sign("12345", "", later, "00000000000000000000000000000004"), "", later)
+	if err != nil {
+		t.Fatalf("verify failure: %v", err)
+	}
+	if len(v.nonces) != 1 {
+		t.Fatalf("unexpected cache size: %d", len(v.nonces))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+	"weisuo/logger"
+	"weisuo/protocol"
+)
+
+func TestUdp(t *testing.T) {
+	errCh := make(chan error)
+	go func() {
+		h := protocol.DefaultHandler()
+		h.Authenticator = func(remoteIp, auth, target string) (string, bool) {
+			return "", auth == "12345"
+		}
+		h.LogLevel = logger.LogLevelDebug
+		h.UDPIdleTimeout = time.Second
+
+		mux := http.NewServeMux()
+		mux.Handle("/proxy", h)
+		err := http.ListenAndServe("127.0.0.1:10081", mux)
+		t.Log("listen failure", err)
+		errCh <- err
+	}()
+
+	go func() {
+		udpConn, err := net.ListenPacket("udp", "127.0.0.1:10091")
+		if err != nil {
+			t.Log("listen failure 2", err)
+			errCh <- err
+			return
+		}
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				t.Log("read udp failure", err)
+				errCh <- err
+				return
+			}
+			_, err = udpConn.WriteTo(buf[:n], addr)
+			if err != nil {
+				t.Log("write udp failure", err)
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	time.Sleep(time.Second)
+
+	echo := func(conn protocol.UDPConn) error {
+		for _, msg := range []string{"1", "22", "333"} {
+			_, err := conn.Write([]byte(msg))
+			if err != nil {
+				return err
+			}
+		}
+
+		buf := make([]byte, 5)
+		for _, msg := range []string{"1", "22", "333"} {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+			if string(buf[:n]) != msg {
+				t.Log("client read data unexpected", string(buf[:n]))
+				return errors.New("client read data")
+			}
+			if addr.String() != "127.0.0.1:10091" {
+				t.Log("client read addr unexpected", addr)
+				return errors.New("client read addr")
+			}
+		}
+
+		// closed by server after idle timeout
+		_, err := conn.Read(buf)
+		if !errors.Is(err, io.EOF) {
+			t.Log("client read unexpected err", err)
+			return errors.New("client read after idle timeout")
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		dialer := protocol.DefaultDialer()
+		dialer.LogLevel = logger.LogLevelDebug
+		conn, err := dialer.DialUDP("ws://127.0.0.1:10081/proxy", "12345", "127.0.0.1:10091")
+		if err != nil {
+			t.Log("client connect failure", err)
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+
+		err = echo(conn)
+		if err != nil {
+			errCh <- err
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		dialer := protocol.DefaultDialer()
+		dialer.LogLevel = logger.LogLevelDebug
+		idleConn, err := dialer.DialIdle("ws://127.0.0.1:10081/proxy", "12345", nil)
+		if err != nil {
+			t.Log("client connect idle failure", err)
+			errCh <- err
+			return
+		}
+
+		conn, err := idleConn.DialUDP("127.0.0.1:10091")
+		if err != nil {
+			t.Log("client connect failure:", err)
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+
+		err = echo(conn)
+		if err != nil {
+			errCh <- err
+		}
+	}()
+
+	doneCh := make(chan int)
+	go func() {
+		wg.Wait()
+		doneCh <- 1
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("failure: %v", err)
+	case <-doneCh:
+		t.Log("ok")
+	}
+}